@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"ninja/chat"
+)
+
+// DefaultPlatform is the platform of records from before there were
+// adapters.
+const DefaultPlatform = "slack"
+
+var Adapters = make(map[string]chat.Adapter)
+
+// AddAdapter hooks an adapter up to the bot.
+func AddAdapter(a chat.Adapter) {
+	a.Receive(BotHandler, ReactionHandler)
+	Adapters[a.Platform()] = a
+}
+
+func AdapterFor(platform string) (chat.Adapter, error) {
+	if platform == "" {
+		platform = DefaultPlatform
+	}
+	adapter, ok := Adapters[platform]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No adapter for %s", platform))
+	}
+	return adapter, nil
+}
+
+// Send delivers reply through the adapter of the platform to is on and
+// returns the id of the new message.
+func Send(to *chat.Message, reply *chat.Reply) (string, error) {
+	adapter, err := AdapterFor(to.Platform)
+	if err != nil {
+		return "", err
+	}
+	return adapter.Send(to, reply)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Who made a change.
+const (
+	ByUser   = "user"
+	BySMS    = "sms"
+	BySystem = "system"
+)
+
+// AuditEntry records a change to a user's phone or runner status.
+type AuditEntry struct {
+	Id     bson.ObjectId `bson:"_id,omitempty"`
+	Time   time.Time     `bson:"time"`
+	TeamId string        `bson:"team_id"`
+	User   bson.ObjectId `bson:"user"`
+	By     string        `bson:"by"`
+	Action string        `bson:"action"`
+	Detail string        `bson:"detail,omitempty"`
+}
+
+// PhoneActions are the actions with the phone number as detail, it's
+// masked with phone.Mask.
+var PhoneActions = []string{"register", "verify"}
+
+// Audit records action on user, failing to do so doesn't stop the change.
+func Audit(user *User, by string, action string, detail string) {
+	log.Infof("Audit: %s %s by %s (%s)", user.Name, action, by, detail)
+
+	entry := AuditEntry{
+		Id:     bson.NewObjectId(),
+		Time:   time.Now(),
+		TeamId: user.TeamId,
+		User:   user.Id,
+		By:     by,
+		Action: action,
+		Detail: detail,
+	}
+	if err := Env.Store.InsertAudit(&entry); err != nil {
+		log.Warn("Could not record audit entry: ", err)
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
-	"bitbucket.org/ckvist/twilio/twirest"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"ninja/chat"
+	"ninja/irc"
+	"ninja/matrix"
+	"ninja/mattermost"
+	"ninja/notify"
+	"ninja/phone"
 	"ninja/slack"
 	"regexp"
 	"strings"
@@ -13,7 +18,7 @@ import (
 )
 
 type ArgMap map[string]string
-type CmdFunc func(args ArgMap, user *User, m *slack.IncomingMessage) *slack.OutgoingMessage
+type CmdFunc func(args ArgMap, user *User, m *chat.Message) *chat.Reply
 type Command struct {
 	Pattern *regexp.Regexp
 	Handler CmdFunc
@@ -21,259 +26,546 @@ type Command struct {
 
 var Commands []Command
 
-func SendCode(user *User) error {
-	log.Infof("Sending code '%s' to %s on %s", user.PhoneCode, user.Name, user.Phone)
+// SendCode texts code to user.
+func SendCode(user *User, code string) error {
+	log.Infof("Sending code to %s on %s", user.Name, user.Phone)
+
+	team, err := GetTeam(user.TeamId)
+	if err != nil {
+		return err
+	}
 
 	text := fmt.Sprintf(
-		"Hey %s! Ninja here, you need to verify this number."+
-			"To do that just write the following in the #coffee channel:\n\nverify %s",
-		user.Name, user.PhoneCode,
+		"Hey %s! Ninja here, you need to verify this number. "+
+			"To do that just send me the following in a direct message on Slack:\n\nverify %s",
+		user.Name, code,
 	)
 
-	msg := twirest.SendMessage{
-		Text: text,
-		To:   user.Phone,
-		From: Env.Vars.TwilioNumber,
-	}
-
-	resp, err := Env.TwiClient.Request(msg)
+	r := notify.Recipient{Name: user.Name, Phone: user.Phone, NoSMS: user.SMSStopped}
+	sid, err := Env.Notifier.Send(notify.SMS, &r, &notify.Notification{From: team.TwilioNumber(), Text: text})
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("Response from twilio: ", resp.Message.Status)
+	// the code is only ever kept hashed
+	RecordDelivery(sid, DeliveryCode, user, nil, CodeDeliveryText)
 	return nil
 }
 
-func HelpCommand(args ArgMap, user *User, m *slack.IncomingMessage) *slack.OutgoingMessage {
-	log.Println(args)
-	return slack.NewMessage("```" +
+// Private wraps a command that deals with personal information so that it
+// only runs in a direct message. Anywhere else the user gets nudged into a
+// direct message instead.
+func Private(handler CmdFunc) CmdFunc {
+	return func(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+		if m.Direct {
+			return handler(args, user, m)
+		}
+
+		dm := chat.DirectReply(fmt.Sprintf(
+			"Hey %s! Let's keep your details between us, send me `%s` in here instead.",
+			user.Name, strings.Fields(m.Text)[0]+" ...",
+		))
+		if _, err := Send(m, dm); err != nil {
+			return ErrorReply(err)
+		}
+
+		return chat.EphemeralReply("Shh! I've sent you a direct message, let's do this in private.")
+	}
+}
+
+func HelpCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	return chat.EphemeralReply("```" +
 		"Ninja words\n" +
 		"---------------------------------------------------\n" +
 		"help                             you'll never guess\n" +
 		"register <phone#>                    become a ninja\n" +
 		"verify <code>                    verify your karate\n" +
+		"unregister                       stop being a ninja\n" +
+		"pause running until <date>             take a break\n" +
+		"resume running                    back from a break\n" +
 		"startrun                         start a coffee-run\n" +
+		"startrun at <cafe>                    run to a cafe\n" +
+		"order <coffee type>                    get a coffee\n" +
+		"order usual                       same as last time\n" +
 		"done                                     finish run\n" +
+		"notify                              how I reach you\n" +
+		"notify <sms|voice|email|dm> ...        change order\n" +
+		"email <address>                   for notifications\n" +
+		"prefs                            when I mention you\n" +
+		"mute / unmute                     run announcements\n" +
+		"cafe <cafe|any>                 only runs to a cafe\n" +
+		"quiet <from>-<to> / quiet off           quiet hours\n" +
+		"summary <sms|dm|email|off>    when your order's off\n" +
+		"emoji                              list order emoji\n" +
+		"emoji :<emoji>: <coffee type>        react to order\n" +
+		"emoji :<emoji>: none                   remove emoji\n" +
+		"mydata                        what I know about you\n" +
+		"forgetme                       forget all about you\n" +
 		"```")
 }
 
-func RegisterCommand(args ArgMap, user *User, m *slack.IncomingMessage) *slack.OutgoingMessage {
-	phone := strings.Replace(args["phone"], " ", "", -1)
+func RegisterCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	team, err := GetTeam(user.TeamId)
+	if err != nil {
+		return ErrorReply(err)
+	}
 
-	if !strings.HasPrefix(phone, "+") {
-		return slack.NewMessage("Invalid phone number, you must specify the country-code. e.g. `+61488888888`")
+	number, err := phone.Normalize(args["phone"], team.Config.Region)
+	if err == phone.ErrNoRegion {
+		return chat.DirectReply("Invalid phone number, you must specify the country-code. e.g. `+61488888888` " +
+			"(or an admin can set a default with `config region <country>`)")
+	} else if err != nil {
+		return chat.DirectReply(fmt.Sprintf("That doesn't look like a phone number to me. %s.", err))
 	}
 
-	if user.Phone == phone {
-		if user.PhoneValid {
-			return slack.NewMessage("I've got your phone number already.")
-		} else {
-			if err := SendCode(user); err != nil {
-				return slack.ErrorMessage(err)
-			}
-			return slack.NewMessage("I've got that number, but you need to validate it. I'll resend the code...")
-		}
+	resend := user.Phone == number
+	if resend && user.PhoneValid {
+		return chat.DirectReply("I've got your phone number already.")
+	}
+
+	if wait := CodeCooling(user, number); wait > 0 {
+		return chat.DirectReply(fmt.Sprintf(
+			"I've just sent a code, give it %d seconds before asking for another one.", int(wait.Seconds()+1),
+		))
+	}
+
+	if resend && user.SMSStopped {
+		return chat.DirectReply(fmt.Sprintf(
+			"You've asked me to stop texting that number, text START to %s and try again.", team.TwilioNumber(),
+		))
 	}
 
-	c := GetCollection("users")
 	was_runner := user.Runner
 
-	user.Phone = phone
+	if !resend {
+		user.SMSStopped = false
+	}
+	user.Phone = number
 	user.PhoneValid = false
-	user.PhoneCode = GenerateCode(6)
 	user.Runner = true
+	code, err := NewCode(user)
+	if err != nil {
+		return ErrorReply(err)
+	}
 
-	if err := c.UpdateId(user.Id, &user); err != nil {
-		return slack.ErrorMessage(err)
+	if err := Env.Store.SaveUser(user); err == ErrDuplicate {
+		return chat.DirectReply("Someone else has registered that number already.")
+	} else if err != nil {
+		return ErrorReply(err)
 	}
 
-	if err := SendCode(user); err != nil {
-		return slack.ErrorMessage(err)
+	Audit(user, ByUser, "register", phone.Mask(number))
+
+	if err := SendCode(user, code); err != nil {
+		return ErrorReply(err)
 	}
 
 	var msg string
-	if was_runner {
+	if resend {
+		msg = "I've got that number, but you need to validate it. I've sent you a new code."
+	} else if was_runner {
 		msg = fmt.Sprintf("Ok %s, got your new number. You need to validate it, I'll send you a text.", user.Name)
 	} else {
 		msg = fmt.Sprintf("Thanks %s! You're now a coffee-runner. Check your phone for instructions.", user.Name)
 	}
 
-	return slack.NewMessage(msg)
+	return chat.DirectReply(msg)
 }
 
-func VerifyCommand(args ArgMap, user *User, m *slack.IncomingMessage) *slack.OutgoingMessage {
+func VerifyCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
 	if !user.Runner {
-		return slack.NewMessage("What are you on about? You need to register first!")
+		return chat.DirectReply("What are you on about? You need to register first!")
 	}
 
 	if user.PhoneValid {
-		return slack.NewMessage("You have already verified your phone, relax!")
+		return chat.DirectReply("You have already verified your phone, relax!")
 	}
 
-	code := strings.ToLower(strings.TrimSpace(args["code"]))
+	if time.Now().After(user.CodeExpires) {
+		return chat.DirectReply("That code has expired, send me `register <phone#>` to get a new one.")
+	}
 
-	if user.PhoneCode == code {
-		log.Infof("User %s verified their phone", user.Name)
+	// counted before it's checked, guesses sent all at once are handled at
+	// the same time and would all get in otherwise
+	attempts, err := Env.Store.AddCodeAttempt(user.Id)
+	if err != nil {
+		return ErrorReply(err)
+	}
+	if attempts > CodeAttempts {
+		return chat.DirectReply("That's too many wrong codes, send me `register <phone#>` to get a new one.")
+	}
+	user.CodeAttempts = attempts - 1
 
-		c := GetCollection("users")
+	code := strings.ToLower(strings.TrimSpace(args["code"]))
 
-		user.PhoneValid = true
+	if CheckCode(user, code) {
+		log.Infof("User %s verified their phone", user.Name)
 
-		if err := c.UpdateId(user.Id, &user); err != nil {
-			return slack.ErrorMessage(err)
+		fields := Fields{"phone_valid": true, "phone_code": "", "code_attempts": 0}
+		if err := Env.Store.UpdateUser(user.Id, fields); err != nil {
+			return ErrorReply(err)
 		}
+		Audit(user, ByUser, "verify", phone.Mask(user.Phone))
 
-		call := twirest.MakeCall{
-			Url:  Env.Vars.AppURL + "/call",
-			To:   user.Phone,
-			From: Env.Vars.TwilioNumber,
+		team, err := GetTeam(user.TeamId)
+		if err != nil {
+			return ErrorReply(err)
 		}
 
-		if _, err := Env.TwiClient.Request(call); err != nil {
-			return slack.ErrorMessage(err)
+		if _, err := Env.Phone.Call(team.TwilioNumber(), user.Phone, Env.Vars.AppURL+"/call"); err != nil {
+			return ErrorReply(err)
 		}
 
-		return slack.NewMessage(fmt.Sprintf("Hehehe %s... I've got your number now! :)", user.Name))
+		return chat.DirectReply(fmt.Sprintf("Hehehe %s... I've got your number now! :)", user.Name))
 	} else {
-		return slack.NewMessage("Hmm... That's not the right code you know.")
+		return chat.DirectReply("Hmm... That's not the right code you know.")
 	}
 }
 
-func StartCommand(args ArgMap, user *User, m *slack.IncomingMessage) *slack.OutgoingMessage {
-	if !user.Runner || !user.PhoneValid {
-		return slack.NewMessage("You're not a runner, register first.")
+func StartCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	// runners without a verified number still get the orders, by dm
+	if !user.Runner {
+		return chat.EphemeralReply("You're not a runner, register first.")
+	}
+	if !user.Running(time.Now()) {
+		return chat.EphemeralReply(fmt.Sprintf(
+			"You're on a break until %s, say `resume running` first.", user.PausedUntil.Format("2006-01-02"),
+		))
+	}
+
+	team, err := GetTeam(m.TeamId)
+	if err != nil {
+		return ErrorReply(err)
 	}
 
-	if Env.ActiveRun != nil {
-		return slack.NewMessage("Already in an active run, please wait for it to finish.")
+	active, err := ActiveRun(m.TeamId)
+	if err != nil {
+		return ErrorReply(err)
+	}
+
+	if active != nil {
+		return chat.EphemeralReply("Already in an active run, please wait for it to finish.")
 	}
 
 	run := &Run{}
 	run.Id = bson.NewObjectId()
+	run.Platform = m.Platform
+	run.TeamId = m.TeamId
 	run.Runner = user.Id
 	run.Items = []Item{}
 	run.Started = time.Now()
+	run.Channel = m.ChannelId
+	run.Cafe = strings.TrimSpace(args["cafe"])
+	run.Active = true
 
 	log.Printf("run %#v", run)
 
-	c := GetCollection("runs")
-
-	if err := c.Insert(run); err != nil {
-		return slack.ErrorMessage(err)
+	if err := Env.Store.InsertRun(run); err != nil {
+		return ErrorReply(err)
 	}
 
-	Env.ActiveRun = &run.Id
-
+	where := ""
+	if run.Cafe != "" {
+		where = " to " + run.Cafe
+	}
 	msg := fmt.Sprintf(
-		"<!channel> %s is starting a coffee-run! Type `order <coffee type>` to get yours. "+
-			"You have 5 minutes or until %s writes `done`.",
-		user.Name, user.Name,
+		"%s%s is starting a coffee-run%s! Type `order <coffee type>` to get yours. "+
+			"You have %d minutes or until %s writes `done`.",
+		Mentions(run, nil), user.Name, where, team.Config.RunMinutes, user.Name,
 	)
 
-	go RunTimer()
-	go RemindTimer()
+	ScheduleRun(run, team)
 
-	return slack.NewMessage(msg)
+	// the announcement becomes the root of the run thread, if we can't post
+	// it through the api the run carries on in the channel
+	ts, err := Send(m, chat.NewReply(msg))
+	if err != nil {
+		log.Warn("Could not start run thread: ", err)
+		return chat.NewReply(msg)
+	}
+
+	run.ThreadTs = ts
+	if err := Env.Store.UpdateRun(run.Id, Fields{"thread_ts": ts}); err != nil {
+		log.Warn("Could not save run thread: ", err)
+	}
+
+	return nil
+}
+
+// ThreadMessage creates a message in the thread of run.
+func ThreadMessage(run *Run, msg string) *chat.Reply {
+	out := chat.NewReply(msg)
+	out.ThreadId = run.ThreadTs
+	return out
 }
 
-func EndRun(user *User) *slack.OutgoingMessage {
-	if Env.ActiveRun == nil {
+// SendRunMessage queues a message that isn't a reply to anyone for the run
+// channel. If the outbox is unavailable the message is sent right away.
+func SendRunMessage(run *Run, m *chat.Reply) error {
+	to := &chat.Message{Platform: run.Platform, TeamId: run.TeamId, ChannelId: run.Channel}
+
+	err := Enqueue(to, m)
+	if err == nil {
 		return nil
 	}
 
-	run := Run{}
-	c := GetCollection("runs")
+	log.Warn("Could not queue message, sending it directly: ", err)
+
+	_, err = Send(to, m)
+	return err
+}
 
-	if err := c.FindId(Env.ActiveRun).One(&run); err != nil {
-		return slack.ErrorMessage(err)
+// EndRun closes run and returns the summary, or nil if someone else already
+// closed it. The runner is looked up if user is nil.
+func EndRun(run *Run, user *User) *chat.Reply {
+	// done and the timer can race, only one of them gets to end the run
+	ended, err := Env.Store.EndRun(run.Id, time.Now())
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return ErrorReply(err)
+	}
+	*run = *ended
+
+	team, err := GetTeam(run.TeamId)
+	if err != nil {
+		return ErrorReply(err)
 	}
 
 	if user == nil {
-		q := GetCollection("users").FindId(run.Runner)
-		if err := q.One(&user); err != nil {
-			log.Panic(err)
+		if user, err = Env.Store.User(run.Runner); err != nil {
+			return ErrorReply(err)
+		}
+		if err := SyncProfile(user); err != nil {
+			log.Warn("Could not sync runner profile: ", err)
 		}
 	}
 
-	Env.ActiveRun = nil
-
 	if len(run.Items) == 0 {
-		return slack.NewMessage("No one ordered :crying_cat_face:")
+		summary := ThreadMessage(run, "No one ordered :crying_cat_face:")
+		summary.Broadcast = true
+		return summary
 	}
 
-	msg := fmt.Sprintf("Ordering done! %s will now fetch your coffees. 1+ coffee karma.\n```", user.Name)
-	sms := "Coffee!\n"
-	for i := 0; i < len(run.Items); i++ {
-		item := run.Items[i]
-		msg += fmt.Sprintf("\n%s: %s", item.OwnerName, item.Name)
-		sms += fmt.Sprintf("\n%s: %s", item.OwnerName, item.Name)
+	lines := strings.Join(OrderLines(run), "\n")
+	msg := fmt.Sprintf("Ordering done! %s will now fetch your coffees. 1+ coffee karma.\n```\n%s```", user.Name, lines)
+	sms := "Coffee!\n\n" + lines
+
+	note := notify.Notification{
+		From:    team.TwilioNumber(),
+		Subject: "Coffee orders",
+		Text:    sms,
+		CallURL: OrderCallURL(run),
+	}
+	provider, id, err := Env.Notifier.Notify(Recipient(user), user.Notify, &note)
+	if err != nil {
+		log.Warn("Could not send order to runner: ", err)
+		msg += fmt.Sprintf("\nI couldn't reach %s, make sure they see this!", user.Name)
+	} else if provider == notify.SMS {
+		RecordDelivery(id, DeliveryOrder, user, run, sms)
+	} else if provider == notify.Voice {
+		msg += fmt.Sprintf("\nI'm calling %s with the order.", user.Name)
 	}
 
-	msg += "```"
+	go SendSummaries(run, user, team.TwilioNumber())
+
+	summary := ThreadMessage(run, msg)
+	summary.Broadcast = true
+	return summary
+}
 
-	req := twirest.SendMessage{
-		Text: sms,
-		To:   user.Phone,
-		From: Env.Vars.TwilioNumber,
+// OrderLines is the order of run, one "name: item" per line.
+func OrderLines(run *Run) []string {
+	lines := []string{}
+	names := CurrentNames(run.Items)
+	for _, item := range run.Items {
+		name, ok := names[item.OwnerId]
+		if !ok {
+			name = item.OwnerName
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, item.Name))
+	}
+	return lines
+}
+
+// ScheduleRun sets up the reminder and the end of run.
+func ScheduleRun(run *Run, team *Team) {
+	ends := run.Started.Add(time.Duration(team.Config.RunMinutes) * time.Minute)
+	remind := ends.Add(-time.Duration(team.Config.ReminderMinutes) * time.Minute)
+
+	if team.Config.ReminderMinutes > 0 && remind.After(time.Now()) {
+		minutes := team.Config.ReminderMinutes
+		time.AfterFunc(remind.Sub(time.Now()), func() {
+			RemindRun(run.Id, minutes)
+		})
 	}
 
-	resp, err := Env.TwiClient.Request(req)
+	time.AfterFunc(ends.Sub(time.Now()), func() {
+		TimeoutRun(run.Id)
+	})
+}
+
+func RemindRun(id bson.ObjectId, minutes int) {
+	run, err := Env.Store.Run(id)
 	if err != nil {
-		return slack.ErrorMessage(err)
+		log.Warn("Could not load run for reminder: ", err)
+		return
+	}
+	if !run.Active {
+		return
+	}
+
+	// only nag the ones who haven't ordered yet
+	ordered := map[string]bool{}
+	for _, item := range run.Items {
+		ordered[item.OwnerId.Hex()] = true
 	}
+	mentions := Mentions(run, ordered)
 
-	log.Debugf("Response from twilio: ", resp.Message.Status)
+	text := fmt.Sprintf("%s%d minutes remaining, get your orders in!", mentions, minutes)
+	if minutes == 1 {
+		text = mentions + "1 minute remaining, get your orders in!"
+	}
 
-	return slack.NewMessage(msg)
+	if err := SendRunMessage(run, ThreadMessage(run, text)); err != nil {
+		log.Warn("Could not send reminder: ", err)
+	}
 }
 
-func RemindTimer() {
-	var this_run string = Env.ActiveRun.String()
-	time.AfterFunc(time.Minute*4, func() {
-		if Env.ActiveRun.String() == this_run {
-			Env.Bot.SendMessage(slack.NewMessage("<!channel> 1 minute remaning, get your orders in!"))
-		}
-	})
+func TimeoutRun(id bson.ObjectId) {
+	run, err := Env.Store.Run(id)
+	if err != nil {
+		log.Warn("Could not load run: ", err)
+		return
+	}
+	if !run.Active {
+		log.Info("Run already ended.. nothing to do")
+		return
+	}
+
+	summary := EndRun(run, nil)
+	if summary == nil {
+		return
+	}
+	if summary.Visibility != chat.Channel {
+		log.Warn("Could not end run: ", summary.Text)
+		return
+	}
+	if err := SendRunMessage(run, summary); err != nil {
+		log.Warn("Could not send run summary: ", err)
+	}
 }
 
-func RunTimer() {
-	time.AfterFunc(time.Minute*5, func() {
-		if Env.ActiveRun == nil {
-			log.Info("Run already ended.. nothing to do")
-		} else {
-			Env.Bot.SendMessage(EndRun(nil))
+// ResumeRuns schedules the ends of runs that were active when we were last
+// shut down.
+func ResumeRuns() {
+	runs, err := Env.Store.ActiveRuns()
+	if err != nil {
+		log.Warn("Could not load active runs: ", err)
+		return
+	}
+
+	for i := 0; i < len(runs); i++ {
+		team, err := GetTeam(runs[i].TeamId)
+		if err != nil {
+			log.Warn("Could not load team for run: ", err)
+			continue
 		}
-	})
+		log.Infof("Resuming run %s", runs[i].Id.Hex())
+		ScheduleRun(&runs[i], team)
+	}
 }
 
-func DoneCommand(args ArgMap, user *User, m *slack.IncomingMessage) *slack.OutgoingMessage {
-	if Env.ActiveRun == nil {
+func DoneCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	run, err := ActiveRun(m.TeamId)
+	if err != nil {
+		return ErrorReply(err)
+	}
+
+	if run == nil {
 		return nil
 	}
-	return EndRun(user)
+
+	// the summary goes through the outbox so it survives slack hiccups
+	summary := EndRun(run, user)
+	if summary == nil || summary.Visibility != chat.Channel {
+		return summary
+	}
+	if err := SendRunMessage(run, summary); err != nil {
+		return ErrorReply(err)
+	}
+	return nil
 }
 
-func OrderCommand(args ArgMap, user *User, m *slack.IncomingMessage) *slack.OutgoingMessage {
-	if Env.ActiveRun == nil {
-		return slack.NewMessage("No one is running, why not start a run yourself with `startrun`")
+func OrderCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	run, err := ActiveRun(m.TeamId)
+	if err != nil {
+		return ErrorReply(err)
+	}
+
+	if run == nil {
+		return chat.EphemeralReply("No one is running, why not start a run yourself with `startrun`")
+	}
+
+	item, err := PlaceOrder(user, run, strings.TrimSpace(args["item"]), "")
+	if err == ErrNoUsual {
+		return chat.EphemeralReply(err.Error())
+	} else if err != nil {
+		return ErrorReply(err)
 	}
 
-	c := GetCollection("runs")
+	// only what they asked for by name is their usual, not reactions
+	if user.Usual != item.Name {
+		user.Usual = item.Name
+		if err := Env.Store.UpdateUser(user.Id, Fields{"usual": item.Name}); err != nil {
+			log.Warn("Could not save usual order: ", err)
+		}
+	}
+
+	return ThreadMessage(run, fmt.Sprintf("%s wants a %s", user.Name, item.Name))
+}
+
+var ErrNoUsual = errors.New("I don't know your usual yet, order something with `order <coffee type>` first.")
+
+// PlaceOrder adds an item to run. Ordering "usual" gets the user whatever
+// they last ordered with the order command.
+func PlaceOrder(user *User, run *Run, name string, reaction string) (*Item, error) {
+	if strings.ToLower(name) == "usual" {
+		if user.Usual == "" {
+			return nil, ErrNoUsual
+		}
+		name = user.Usual
+	}
 
 	item := Item{
-		Name:      strings.TrimSpace(args["item"]),
+		Name:      name,
 		OwnerId:   user.Id,
 		OwnerName: user.Name,
+		Reaction:  reaction,
 	}
 
-	update := bson.M{"$push": bson.M{"items": item}}
-
-	if err := c.UpdateId(Env.ActiveRun, update); err != nil {
-		return slack.ErrorMessage(err)
+	if err := Env.Store.AddItem(run.Id, item); err != nil {
+		return nil, err
 	}
+	return &item, nil
+}
+
+// CancelOrder removes the item user ordered with reaction from run, returns
+// nil if there was no such item.
+func CancelOrder(user *User, run *Run, reaction string) (*Item, error) {
+	for i := 0; i < len(run.Items); i++ {
+		item := run.Items[i]
+		if item.OwnerId != user.Id || item.Reaction != reaction {
+			continue
+		}
+
+		if err := Env.Store.RemoveItem(run.Id, user.Id, reaction); err != nil {
+			return nil, err
+		}
 
-	return slack.NewMessage(fmt.Sprintf("%s wants a %s", user.Name, item.Name))
+		return &item, nil
+	}
+	return nil, nil
 }
 
 func AddCommand(pattern string, handler CmdFunc) {
@@ -287,31 +579,156 @@ func AddCommand(pattern string, handler CmdFunc) {
 	Commands = append(Commands, cmd)
 }
 
-func GetUser(m *slack.IncomingMessage) *User {
-	user := User{}
-	c := GetCollection("users")
-	q := c.Find(bson.M{"user_id": m.UserId})
+// GetUser loads the sender of m, users we haven't seen before are created.
+func GetUser(m *chat.Message) (*User, error) {
+	user, err := Env.Store.FindUser(m.TeamId, m.UserId)
+	if err == ErrNotFound {
+		// users from before we had teams belong to whoever claims them first
+		user, err = Env.Store.ClaimLegacyUser(m.TeamId, m.UserId)
+	}
 
-	if err := q.One(&user); err != nil {
-		if err == mgo.ErrNotFound {
+	if err != nil {
+		if err == ErrNotFound {
 			log.Infof("Creating new user %s (%s)", m.UserName, m.UserId)
+			user = &User{}
 			user.Id = bson.NewObjectId()
+			user.Platform = m.Platform
+			user.TeamId = m.TeamId
 			user.UserId = m.UserId
 			user.Name = m.UserName
+			user.Username = m.UserName
+			if user.Name == "" {
+				// events don't carry the user name
+				user.Name = m.UserId
+			}
 			user.Runner = false
 			user.PhoneValid = false
-			if err := c.Insert(&user); err != nil {
-				log.Panic(err)
+			if err := Env.Store.InsertUser(user); err == ErrDuplicate {
+				// another message from them got there first
+				return Env.Store.FindUser(m.TeamId, m.UserId)
+			} else if err != nil {
+				return nil, err
 			}
 		} else {
-			log.Panic(err)
+			return nil, err
+		}
+	} else if user.SyncedAt.IsZero() && m.UserName != "" && m.UserName != user.Name {
+		// without a synced profile the webhook user name is the best we have
+		user.Name = m.UserName
+		if err := Env.Store.UpdateUser(user.Id, Fields{"name": user.Name}); err != nil {
+			log.Warn("Could not update user name: ", err)
+		}
+	}
+
+	if err := SyncProfile(user); err != nil {
+		log.Warnf("Could not sync profile of %s: %s", user.UserId, err)
+	}
+
+	return user, nil
+}
+
+// ProfileTTL is how long a synced profile is used before it's fetched
+// again.
+const ProfileTTL = time.Hour
+
+// SyncProfile refreshes the name and profile of user from their chat
+// platform when the copy we have is stale.
+func SyncProfile(user *User) error {
+	if time.Since(user.SyncedAt) < ProfileTTL {
+		return nil
+	}
+
+	adapter, err := AdapterFor(user.Platform)
+	if err != nil {
+		return err
+	}
+
+	profile, err := adapter.LookupUser(user.TeamId, user.UserId)
+	if err == chat.ErrUnsupported {
+		// stick with the names that come with messages
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	user.DisplayName = profile.DisplayName
+	user.RealName = profile.RealName
+	user.Avatar = profile.Avatar
+	// the profile only fills in for an address they haven't given us
+	if user.Email == "" {
+		user.Email = profile.Email
+	}
+	user.Timezone = profile.Timezone
+	if profile.Name != "" {
+		user.Username = profile.Name
+	}
+	user.Deleted = profile.Deleted
+	user.Admin = profile.Admin
+	user.SyncedAt = time.Now()
+
+	switch {
+	case profile.DisplayName != "":
+		user.Name = profile.DisplayName
+	case profile.RealName != "":
+		user.Name = profile.RealName
+	case profile.Name != "":
+		user.Name = profile.Name
+	}
+
+	update := Fields{
+		"name":         user.Name,
+		"username":     user.Username,
+		"display_name": user.DisplayName,
+		"real_name":    user.RealName,
+		"avatar":       user.Avatar,
+		"email":        user.Email,
+		"timezone":     user.Timezone,
+		"deleted":      user.Deleted,
+		"admin":        user.Admin,
+		"synced_at":    user.SyncedAt,
+	}
+
+	return Env.Store.UpdateUser(user.Id, update)
+}
+
+// CurrentNames looks up the current names of the owners of items, keyed by
+// user id.
+func CurrentNames(items []Item) map[bson.ObjectId]string {
+	names := make(map[bson.ObjectId]string)
+
+	ids := []bson.ObjectId{}
+	for i := 0; i < len(items); i++ {
+		ids = append(ids, items[i].OwnerId)
+	}
+
+	users, err := Env.Store.Users(ids)
+	if err != nil {
+		log.Warn("Could not look up user names: ", err)
+		return names
+	}
+
+	for i := 0; i < len(users); i++ {
+		if err := SyncProfile(&users[i]); err != nil {
+			log.Warnf("Could not sync profile of %s: %s", users[i].UserId, err)
 		}
+		names[users[i].Id] = users[i].Name
 	}
 
-	return &user
+	return names
 }
 
-func BotHandler(m *slack.IncomingMessage) *slack.OutgoingMessage {
+// BrainDown is what people get when the store can't be reached.
+const BrainDown = "I can't reach my brain right now, try again in a bit."
+
+// ErrorReply tells the user what went wrong.
+func ErrorReply(err error) *chat.Reply {
+	if err == ErrUnavailable {
+		return chat.EphemeralReply(BrainDown)
+	}
+	return chat.ErrorReply(err)
+}
+
+func BotHandler(m *chat.Message) *chat.Reply {
 	text := strings.TrimSpace(m.Text)
 	var cmd Command
 	for i := 0; i < len(Commands); i++ {
@@ -324,24 +741,86 @@ func BotHandler(m *slack.IncomingMessage) *slack.OutgoingMessage {
 				args[names[j]] = values[j]
 			}
 			log.Debugf("matched command %s", cmd.Pattern)
-			return cmd.Handler(args, GetUser(m), m)
+			user, err := GetUser(m)
+			if err != nil {
+				return ErrorReply(err)
+			}
+			return cmd.Handler(args, user, m)
 		}
 
 	}
 	return nil
 }
 
-func SetupBot() {
+func SetupCommands() {
 	AddCommand("^help$", HelpCommand)
-	AddCommand("^register (?P<phone>[+0-9 ]+)$", RegisterCommand)
-	AddCommand("^verify (?P<code>.*)$", VerifyCommand)
+	AddCommand("^register (?P<phone>[+0-9 ().-]+)$", Private(RegisterCommand))
+	AddCommand("^verify (?P<code>.*)$", Private(VerifyCommand))
+	AddCommand("^unregister$", UnregisterCommand)
+	AddCommand("^pause running until (?P<date>.+)$", PauseCommand)
+	AddCommand("^resume running$", ResumeCommand)
 	AddCommand("^startrun$", StartCommand)
+	AddCommand("^startrun at (?P<cafe>.+)$", StartCommand)
 	AddCommand("^order (?P<item>[a-zA-Z0-9 ]+)$", OrderCommand)
 	AddCommand("^done$", DoneCommand)
+	AddCommand("^config$", ConfigListCommand)
+	AddCommand("^config (?P<key>[a-z_]+) (?P<value>.+)$", ConfigCommand)
+	AddCommand("^notify$", NotifyListCommand)
+	AddCommand("^notify (?P<order>[a-z ]+)$", NotifyCommand)
+	AddCommand("^email (?P<email>\\S+)$", Private(EmailCommand))
+	AddCommand("^prefs$", PrefsCommand)
+	AddCommand("^(?P<mute>mute|unmute)$", MuteCommand)
+	AddCommand("^cafe (?P<cafe>.+)$", CafeCommand)
+	AddCommand("^quiet (?P<hours>off|[0-9]+-[0-9]+)$", QuietCommand)
+	AddCommand("^summary (?P<provider>[a-z]+)$", SummaryCommand)
+	AddCommand("^mydata$", Private(MyDataCommand))
+	AddCommand("^forgetme(?: (?P<confirm>confirm))?$", ForgetMeCommand)
+	AddCommand("^forget (?P<user>\\S+)$", ForgetCommand)
+	AddCommand("^emoji$", EmojiListCommand)
+	AddCommand("^emoji :(?P<emoji>[a-z0-9_+'-]+): (?P<item>[a-zA-Z0-9 ]+)$", EmojiCommand)
+}
+
+func SetupBot() {
+	SetupCommands()
 
 	Env.Bot = &slack.Bot{
-		Subdomain:      Env.Vars.SlackDomain,
-		Token:          Env.Vars.SlackToken,
-		MessageHandler: BotHandler,
+		Subdomain:     Env.Vars.SlackDomain,
+		Token:         Env.Vars.SlackToken,
+		SigningSecret: Env.Vars.SlackSigningSecret,
+		APIToken:      Env.Vars.SlackAPIToken,
+		Seen:          Seen,
+		TeamToken:     TeamToken,
+	}
+	AddAdapter(slack.NewAdapter(Env.Bot))
+
+	if Env.Vars.MattermostURL != "" {
+		Env.Mattermost = &mattermost.Adapter{
+			URL:          Env.Vars.MattermostURL,
+			Token:        Env.Vars.MattermostToken,
+			WebhookToken: Env.Vars.MattermostWebhookToken,
+		}
+		AddAdapter(Env.Mattermost)
+	}
+
+	if Env.Vars.IRCServer != "" {
+		adapter := &irc.Adapter{
+			Server:   Env.Vars.IRCServer,
+			TLS:      Env.Vars.IRCTLS,
+			Nick:     Env.Vars.IRCNick,
+			Password: Env.Vars.IRCPassword,
+			Channels: strings.Split(Env.Vars.IRCChannels, ","),
+			Throttle: 500 * time.Millisecond,
+		}
+		AddAdapter(adapter)
+		go adapter.Run()
+	}
+
+	if Env.Vars.MatrixHomeserver != "" {
+		adapter := &matrix.Adapter{
+			Homeserver: Env.Vars.MatrixHomeserver,
+			Token:      Env.Vars.MatrixToken,
+		}
+		AddAdapter(adapter)
+		go adapter.Run()
 	}
 }
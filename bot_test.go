@@ -0,0 +1,88 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"ninja/chat"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUsual(t *testing.T) {
+	store := Env.Store
+	Env.Store = NewMemoryStore()
+	defer func() { Env.Store = store }()
+
+	user := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U1", Name: "bob"}
+	if err := Env.Store.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+	run := &Run{Id: bson.NewObjectId(), TeamId: "T1", Runner: bson.NewObjectId(), Started: time.Now(), Active: true}
+	if err := Env.Store.InsertRun(run); err != nil {
+		t.Fatal(err)
+	}
+	usual := func() string {
+		saved, err := Env.Store.User(user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved.Usual
+	}
+
+	OrderCommand(ArgMap{"item": "latte"}, user, &chat.Message{TeamId: "T1"})
+	if got := usual(); got != "latte" {
+		t.Errorf("usual after ordering a latte is %q", got)
+	}
+
+	// a reaction order is a one off
+	if _, err := PlaceOrder(user, run, "tea", "tea"); err != nil {
+		t.Fatal(err)
+	}
+	if got := usual(); got != "latte" || user.Usual != "latte" {
+		t.Errorf("usual after a tea reaction is %q", got)
+	}
+
+	item, err := PlaceOrder(user, run, "usual", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Name != "latte" {
+		t.Errorf("the usual is a %s", item.Name)
+	}
+}
+
+func TestVerifyAttempts(t *testing.T) {
+	store := Env.Store
+	Env.Store = NewMemoryStore()
+	defer func() { Env.Store = store }()
+
+	user := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U1", Name: "bob", Runner: true, Phone: "+46701234567"}
+	code, err := NewCode(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Env.Store.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	// wrong guesses all at once, each from the same stale copy
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3*CodeAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stale := *user
+			VerifyCommand(ArgMap{"code": "nope"}, &stale, &chat.Message{})
+		}()
+	}
+	wg.Wait()
+
+	reply := VerifyCommand(ArgMap{"code": code}, user, &chat.Message{})
+	if !strings.Contains(reply.Text, "too many") {
+		t.Errorf("the right code after %d wrong ones got %q", 3*CodeAttempts, reply.Text)
+	}
+	if saved, _ := Env.Store.User(user.Id); saved.PhoneValid {
+		t.Error("verified after too many wrong codes")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bitbucket.org/ckvist/twilio/twiml"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OrderCallTries is how many times the order is read out before we give up
+// waiting for the runner to press something.
+const OrderCallTries = 3
+
+// OrderCallURL is the TwiML that reads out the order of run.
+func OrderCallURL(run *Run) string {
+	return Env.Vars.AppURL + "/order/call?run=" + run.Id.Hex()
+}
+
+// speak escapes text for a <Say>, twiml doesn't.
+func speak(text string) string {
+	var out bytes.Buffer
+	xml.EscapeText(&out, []byte(text))
+	return out.String()
+}
+
+func callRun(r *http.Request) (*Run, error) {
+	id := r.FormValue("run")
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	return Env.Store.Run(bson.ObjectIdHex(id))
+}
+
+// OrderCallHandler reads out the order and asks the runner to press 1 to
+// hear it again or 2 to confirm.
+func OrderCallHandler(w http.ResponseWriter, r *http.Request) {
+	run, err := callRun(r)
+	if err != nil {
+		log.Warnf("No run for order call %s: %s", r.FormValue("run"), err)
+		http.Error(w, "No such run", http.StatusNotFound)
+		return
+	}
+
+	try, _ := strconv.Atoi(r.FormValue("try"))
+	resp := twiml.NewResponse()
+
+	if try >= OrderCallTries {
+		resp.Action(twiml.Say{Text: "I'll post the order in the channel instead. Bye!"}, twiml.Hangup{})
+		resp.Send(w)
+		return
+	}
+
+	text := "Here's the coffee order. " + strings.Join(OrderLines(run), ". ") + "."
+	resp.Gather(
+		twiml.Gather{Action: Env.Vars.AppURL + "/order/answer?run=" + run.Id.Hex(), NumDigits: 1, Timeout: 5},
+		twiml.Say{Text: speak(text)},
+		twiml.Say{Text: "Press 1 to hear it again, or 2 to confirm."},
+	)
+	// no answer, read it out again
+	resp.Action(twiml.Redirect{Url: fmt.Sprintf("%s&try=%d", OrderCallURL(run), try+1)})
+	resp.Send(w)
+}
+
+// OrderAnswerHandler is where the runner's key press ends up.
+func OrderAnswerHandler(w http.ResponseWriter, r *http.Request) {
+	run, err := callRun(r)
+	if err != nil {
+		log.Warnf("No run for order answer %s: %s", r.FormValue("run"), err)
+		http.Error(w, "No such run", http.StatusNotFound)
+		return
+	}
+
+	resp := twiml.NewResponse()
+
+	if r.PostFormValue("Digits") != "2" {
+		resp.Action(twiml.Redirect{Url: OrderCallURL(run)})
+		resp.Send(w)
+		return
+	}
+
+	if run.Confirmed.IsZero() {
+		ConfirmRun(run)
+	}
+
+	resp.Action(twiml.Say{Text: "Thanks, enjoy the coffee!"}, twiml.Hangup{})
+	resp.Send(w)
+}
+
+// ConfirmRun records that the runner got the order and lets the channel know.
+func ConfirmRun(run *Run) {
+	if err := Env.Store.UpdateRun(run.Id, Fields{"confirmed": time.Now()}); err != nil {
+		log.Warn("Could not confirm run: ", err)
+		return
+	}
+
+	name := "The runner"
+	if runner, err := Env.Store.User(run.Runner); err == nil {
+		name = runner.Name
+	}
+
+	msg := fmt.Sprintf("%s confirmed the order over the phone :+1:", name)
+	if err := SendRunMessage(run, ThreadMessage(run, msg)); err != nil {
+		log.Warn("Could not announce confirmed run: ", err)
+	}
+}
@@ -0,0 +1,124 @@
+// Package chat is the platform neutral model the bot talks in. Each chat
+// platform gets an Adapter that turns its messages into these and back.
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Visibility controls who gets to see a reply.
+type Visibility int
+
+const (
+	// Posted to the channel the message came from.
+	Channel Visibility = iota
+	// Only shown to the user who sent the message.
+	Ephemeral
+	// Sent as a direct message to the user.
+	Direct
+)
+
+// Message is something someone said to the bot. It's also used to address
+// messages the bot sends on its own, then only the platform, team, channel
+// and user need to be set.
+type Message struct {
+	Platform  string
+	TeamId    string
+	ChannelId string
+	Direct    bool
+	UserId    string
+	UserName  string
+	Text      string
+	// Id identifies the message on its platform.
+	Id string
+}
+
+// Reply is something the bot says.
+type Reply struct {
+	Text       string     `bson:"text"`
+	Visibility Visibility `bson:"visibility"`
+	// ThreadId puts the reply in a thread, Broadcast also shows it in the
+	// channel on platforms that support it.
+	ThreadId  string `bson:"thread_id"`
+	Broadcast bool   `bson:"broadcast"`
+}
+
+// Reaction is an emoji being added to or removed from a message.
+type Reaction struct {
+	Platform  string
+	TeamId    string
+	UserId    string
+	Emoji     string
+	ChannelId string
+	MessageId string
+	Added     bool
+}
+
+// Profile is the public part of a user.
+type Profile struct {
+	Id          string
+	Name        string
+	DisplayName string
+	RealName    string
+	Avatar      string
+	Email       string
+	Timezone    string
+	Deleted     bool
+	Admin       bool
+}
+
+type MessageHandler func(m *Message) *Reply
+type ReactionHandler func(r *Reaction) *Reply
+
+// Adapter connects the bot to a chat platform.
+type Adapter interface {
+	// Platform is the name messages from the adapter are tagged with.
+	Platform() string
+	// Receive sets the handlers messages and reactions are passed to,
+	// adapters for platforms without reactions ignore the second one.
+	Receive(messages MessageHandler, reactions ReactionHandler)
+	// Send delivers reply to the channel, thread or user of to and returns
+	// the id of the new message if there is one.
+	Send(to *Message, reply *Reply) (string, error)
+	// LookupUser fetches the profile of a user.
+	LookupUser(teamId string, userId string) (*Profile, error)
+	// ChannelMembers lists the users in a channel, leaving out the bot.
+	// Profiles only have what the platform gives along with the list, at
+	// least the Id.
+	ChannelMembers(teamId string, channelId string) ([]Profile, error)
+	// Mention is how to address a user in a message so they get notified,
+	// username is for platforms that mention by name.
+	Mention(userId string, username string) string
+}
+
+// ErrUnsupported is returned by adapters for things their platform, or the
+// way it's configured, can't do.
+var ErrUnsupported = errors.New("Not supported")
+
+// RateLimitError is returned by adapters when the platform asks us to slow
+// down.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Rate limited, retry after %s", e.RetryAfter)
+}
+
+func NewReply(text string) *Reply {
+	return &Reply{Text: text}
+}
+
+func EphemeralReply(text string) *Reply {
+	return &Reply{Text: text, Visibility: Ephemeral}
+}
+
+func DirectReply(text string) *Reply {
+	return &Reply{Text: text, Visibility: Direct}
+}
+
+func ErrorReply(err error) *Reply {
+	return EphemeralReply(fmt.Sprintf("ERROR: %s", err))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+)
+
+// CodeDeliveryText is kept as the text of a delivered code instead of the
+// code itself.
+const CodeDeliveryText = "verification code"
+
+const (
+	// CodeTTL is how long a verification code works for.
+	CodeTTL = 15 * time.Minute
+	// CodeAttempts is how many wrong codes we take before the code stops
+	// working and a new one has to be requested.
+	CodeAttempts = 5
+	// CodeCooldown is how long people have to wait between codes, per user
+	// and per number.
+	CodeCooldown = time.Minute
+)
+
+// HashCode is how codes are stored, salted with the user so the same code
+// doesn't hash the same for everyone.
+func HashCode(user *User, code string) string {
+	sum := sha256.Sum256([]byte(user.Id.Hex() + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// CodeCooling reports how long until user can get another code sent to
+// number, zero if they can have one now.
+func CodeCooling(user *User, number string) time.Duration {
+	wait := user.CodeSent.Add(CodeCooldown).Sub(time.Now())
+
+	if last, err := Env.Store.LastDelivery(PhoneIndex(number), DeliveryCode); err == nil {
+		if w := last.Created.Add(CodeCooldown).Sub(time.Now()); w > wait {
+			wait = w
+		}
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// NewCode gives user a new code, only its hash is kept. The user needs to be
+// saved afterwards.
+func NewCode(user *User) (string, error) {
+	code, err := GenerateCode(6)
+	if err != nil {
+		return "", err
+	}
+
+	user.PhoneCode = HashCode(user, code)
+	user.CodeExpires = time.Now().Add(CodeTTL)
+	user.CodeAttempts = 0
+	user.CodeSent = time.Now()
+	return code, nil
+}
+
+// CheckCode reports whether code is the current, unexpired code of user.
+func CheckCode(user *User, code string) bool {
+	if user.PhoneCode == "" || time.Now().After(user.CodeExpires) || user.CodeAttempts >= CodeAttempts {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(HashCode(user, code)), []byte(user.PhoneCode)) == 1
+}
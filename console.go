@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"ninja/console"
+	"ninja/notify"
+	"os"
+)
+
+// RunConsole is `ninja console [--store url]`, it runs the bot in the
+// terminal. Everything is kept in memory, unless --store says otherwise, and
+// nothing leaves the process, so it works without mongo, slack or twilio.
+// STORE_URL is left alone on purpose, console users are all admins.
+func RunConsole(args []string) {
+	flags := flag.NewFlagSet("console", flag.ExitOnError)
+	storeURL := flags.String("store", "", "keep things in this store instead of memory, e.g. file:///tmp/ninja.db")
+	flags.Parse(args)
+
+	log.SetOutput(os.Stderr)
+
+	Env.Store = NewMemoryStore()
+	if *storeURL != "" {
+		store, err := OpenStore(*storeURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		Env.Store = store
+	}
+	SetupNotifier(&notify.Printer{Out: os.Stdout})
+	// nothing leaves the process
+	delete(Env.Notifier.Providers, notify.Email)
+
+	SetupCommands()
+
+	adapter := &console.Adapter{
+		In:      os.Stdin,
+		Out:     os.Stdout,
+		Team:    "console",
+		User:    "you",
+		Channel: "coffee",
+	}
+	AddAdapter(adapter)
+
+	SetupOutbox()
+
+	fmt.Println("Ninja console, type help for commands and /help for the console.")
+	if err := adapter.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
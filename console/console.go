@@ -0,0 +1,202 @@
+// Package console lets you talk to the bot from a terminal, one line is one
+// message. Lines starting with a slash are for the console itself.
+package console
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"ninja/chat"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const Platform = "console"
+
+// DirectChannel is the channel name for direct messages with the bot.
+const DirectChannel = "dm"
+
+const Usage = `/as <user>         talk as someone else
+/channel <name>    move to another channel, dm for a direct message
+/react <emoji>     react to the last thing the bot said in the channel
+/unreact <emoji>   take a reaction back
+/quit              bye`
+
+type Adapter struct {
+	In  io.Reader
+	Out io.Writer
+	// Team, User and Channel are who you are and where you're talking.
+	Team    string
+	User    string
+	Channel string
+
+	messages  chat.MessageHandler
+	reactions chat.ReactionHandler
+
+	sync.Mutex
+	lastId int
+	// last message the bot posted outside of a thread, per channel
+	posted map[string]string
+}
+
+func (a *Adapter) Platform() string {
+	return Platform
+}
+
+func (a *Adapter) Receive(messages chat.MessageHandler, reactions chat.ReactionHandler) {
+	a.messages = messages
+	a.reactions = reactions
+}
+
+func (a *Adapter) nextId() string {
+	a.Lock()
+	defer a.Unlock()
+	a.lastId++
+	return strconv.Itoa(a.lastId)
+}
+
+func (a *Adapter) printf(format string, args ...interface{}) {
+	a.Lock()
+	defer a.Unlock()
+	fmt.Fprintf(a.Out, format, args...)
+}
+
+func (a *Adapter) message(text string) *chat.Message {
+	return &chat.Message{
+		Platform:  Platform,
+		TeamId:    a.Team,
+		ChannelId: a.Channel,
+		Direct:    a.Channel == DirectChannel,
+		UserId:    a.User,
+		UserName:  a.User,
+		Text:      text,
+		Id:        a.nextId(),
+	}
+}
+
+// Send prints reply with a prefix saying where it went.
+func (a *Adapter) Send(to *chat.Message, reply *chat.Reply) (string, error) {
+	id := a.nextId()
+
+	var where string
+	switch {
+	case reply.Visibility == chat.Direct || to.ChannelId == DirectChannel:
+		where = "@" + to.UserId
+	case to.ChannelId == "":
+		return "", chat.ErrUnsupported
+	default:
+		where = "#" + to.ChannelId
+	}
+	if reply.Visibility == chat.Ephemeral && to.ChannelId != DirectChannel {
+		where += " (only " + to.UserId + ")"
+	}
+	if reply.ThreadId != "" {
+		where += " > " + reply.ThreadId
+	} else if reply.Visibility == chat.Channel {
+		a.Lock()
+		if a.posted == nil {
+			a.posted = make(map[string]string)
+		}
+		a.posted[to.ChannelId] = id
+		a.Unlock()
+	}
+
+	a.printf("%s [%s] ninja: %s\n", where, id, reply.Text)
+	return id, nil
+}
+
+// LookupUser makes up a profile, everyone is an admin in the console.
+func (a *Adapter) LookupUser(teamId string, userId string) (*chat.Profile, error) {
+	return &chat.Profile{Id: userId, Name: userId, Admin: true}, nil
+}
+
+// ChannelMembers isn't supported, anyone can be in any channel.
+func (a *Adapter) ChannelMembers(teamId string, channelId string) ([]chat.Profile, error) {
+	return nil, chat.ErrUnsupported
+}
+
+func (a *Adapter) Mention(userId string, username string) string {
+	return "@" + userId
+}
+
+func (a *Adapter) react(emoji string, added bool) {
+	a.Lock()
+	message := a.posted[a.Channel]
+	a.Unlock()
+
+	if message == "" || a.reactions == nil {
+		a.printf("Nothing to react to in #%s\n", a.Channel)
+		return
+	}
+
+	reaction := chat.Reaction{
+		Platform:  Platform,
+		TeamId:    a.Team,
+		UserId:    a.User,
+		Emoji:     strings.Trim(emoji, ":"),
+		ChannelId: a.Channel,
+		MessageId: message,
+		Added:     added,
+	}
+	if reply := a.reactions(&reaction); reply != nil {
+		a.Send(a.message(""), reply)
+	}
+}
+
+// command handles a console command and reports whether to carry on.
+func (a *Adapter) command(line string) bool {
+	fields := strings.Fields(line)
+	arg := ""
+	if len(fields) > 1 {
+		arg = fields[1]
+	}
+
+	switch {
+	case fields[0] == "/quit":
+		return false
+	case fields[0] == "/as" && arg != "":
+		a.User = arg
+	case fields[0] == "/channel" && arg != "":
+		a.Channel = strings.TrimPrefix(arg, "#")
+	case fields[0] == "/react" && arg != "":
+		a.react(arg, true)
+	case fields[0] == "/unreact" && arg != "":
+		a.react(arg, false)
+	default:
+		a.printf("%s\n", Usage)
+	}
+	return true
+}
+
+func (a *Adapter) prompt() {
+	a.printf("%s@%s> ", a.User, a.Channel)
+}
+
+// Run reads messages until the input runs out or someone types /quit.
+func (a *Adapter) Run() error {
+	scanner := bufio.NewScanner(a.In)
+	for a.prompt(); scanner.Scan(); a.prompt() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "/") {
+			if !a.command(line) {
+				return nil
+			}
+			continue
+		}
+
+		if a.messages == nil {
+			continue
+		}
+
+		m := a.message(line)
+		if reply := a.messages(m); reply != nil {
+			a.Send(m, reply)
+		}
+	}
+	return scanner.Err()
+}
@@ -2,57 +2,141 @@ package main
 
 import (
 	log "github.com/Sirupsen/logrus"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"net/url"
 	"time"
 )
 
 type User struct {
-	Id         bson.ObjectId `bson:"_id,omitempty"`
-	UserId     string        `bson:"user_id"`
-	Name       string        `bson:"name"`
-	Phone      string        `bson:"phone"`
-	PhoneValid bool          `bson:"phone_valid"`
-	PhoneCode  string        `bson:"phone_code"`
-	Runner     bool          `bson:"runner"`
+	Id           bson.ObjectId `bson:"_id,omitempty"`
+	Platform     string        `bson:"platform"`
+	TeamId       string        `bson:"team_id"`
+	UserId       string        `bson:"user_id"`
+	Name         string        `bson:"name"`
+	Username     string        `bson:"username"`
+	Phone        string        `bson:"phone,omitempty"`
+	PhoneValid   bool          `bson:"phone_valid"`
+	PhoneCode    string        `bson:"phone_code"`
+	CodeExpires  time.Time     `bson:"code_expires"`
+	CodeAttempts int           `bson:"code_attempts"`
+	CodeSent     time.Time     `bson:"code_sent"`
+	SMSStopped   bool          `bson:"sms_stopped"`
+	Runner       bool          `bson:"runner"`
+	PausedUntil  time.Time     `bson:"paused_until"`
+	Usual        string        `bson:"usual"`
+	Email        string        `bson:"email"`
+	Notify       []string      `bson:"notify"`
+	Prefs        Prefs         `bson:"prefs"`
+
+	// synced from the slack profile
+	DisplayName string    `bson:"display_name"`
+	RealName    string    `bson:"real_name"`
+	Avatar      string    `bson:"avatar"`
+	Timezone    string    `bson:"timezone"`
+	Deleted     bool      `bson:"deleted"`
+	Admin       bool      `bson:"admin"`
+	SyncedAt    time.Time `bson:"synced_at"`
+
+	// the phone as it was stored, see SetBSON
+	phoneSealed string
 }
 
 type Item struct {
 	Name      string        `bson:"name"`
 	OwnerId   bson.ObjectId `bson:"owner_id"`
 	OwnerName string        `bson:"owner_name"`
+	Reaction  string        `bson:"reaction,omitempty"`
 }
 
 type Run struct {
-	Id      bson.ObjectId `bson:"_id,omitempty"`
-	Runner  bson.ObjectId `bson:"runner"`
-	Items   []Item        `bson:"items"`
-	Started time.Time     `bson:"started"`
+	Id        bson.ObjectId `bson:"_id,omitempty"`
+	Platform  string        `bson:"platform"`
+	TeamId    string        `bson:"team_id"`
+	Runner    bson.ObjectId `bson:"runner"`
+	Items     []Item        `bson:"items"`
+	Started   time.Time     `bson:"started"`
+	Ended     time.Time     `bson:"ended"`
+	Active    bool          `bson:"active"`
+	Channel   string        `bson:"channel"`
+	ThreadTs  string        `bson:"thread_ts"`
+	Confirmed time.Time     `bson:"confirmed"`
+	Cafe      string        `bson:"cafe,omitempty"`
 }
 
-func GetCollection(name string) *mgo.Collection {
-	session := Env.DBSession //.Clone()
-	collection := session.DB(Env.Vars.MongoDB).C(name)
-	return collection
+// Channel holds per channel settings.
+type Channel struct {
+	Id        bson.ObjectId     `bson:"_id,omitempty"`
+	TeamId    string            `bson:"team_id"`
+	ChannelId string            `bson:"channel_id"`
+	Emoji     map[string]string `bson:"emoji"`
 }
 
-func SetupDatabase() {
-	log.SetFormatter(&log.TextFormatter{ForceColors: Env.Vars.ForceColors})
+// GetChannel loads the settings for a channel, channels that haven't been
+// configured get an empty set of settings.
+func GetChannel(teamId string, channelId string) (*Channel, error) {
+	channel, err := Env.Store.FindChannel(teamId, channelId)
+	if err == ErrNotFound {
+		channel = &Channel{}
+		channel.TeamId = teamId
+		channel.ChannelId = channelId
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if channel.Emoji == nil {
+		channel.Emoji = make(map[string]string)
+	}
+	return channel, nil
+}
 
-	u, err := url.Parse(Env.Vars.MongoURL)
+// ActiveRun returns the run in progress for a team, or nil if there is none.
+func ActiveRun(teamId string) (*Run, error) {
+	run, err := Env.Store.ActiveRun(teamId)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return run, err
+}
+
+// SetupDatabase opens the store before anything can ask it for things. Mongo
+// is connected to in the background, until it's there the bot answers with
+// BrainDown instead of not starting at all.
+func SetupDatabase() {
+	storeURL := StoreURL()
+	u, err := url.Parse(storeURL)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	log.Infof("Connectiong to database %s", u.Host)
+	log.Infof("Opening %s store %s", u.Scheme, u.Host+u.Path)
+
+	if u.Scheme == "mongodb" {
+		store := &MongoStore{DB: Env.Vars.MongoDB}
+		Env.Store = store
+		go func() {
+			store.Connect(storeURL)
+			startStore()
+		}()
+		return
+	}
 
-	session, err := mgo.Dial(Env.Vars.MongoURL)
+	store, err := OpenStore(storeURL)
 	if err != nil {
 		log.Panic(err)
 	}
+	Env.Store = store
+	go startStore()
+}
 
-	Env.DBSession = session
+func startStore() {
+	log.Infof("Opened store")
+
+	if err := Env.Store.Setup(); err != nil {
+		log.Warn("Could not set up database: ", err)
+	}
+	ResumeRuns()
 
-	log.Infof("Connected to database (%s)", Env.Vars.MongoDB)
+	// the outbox lives in the database so it can't start before it
+	SetupOutbox()
 }
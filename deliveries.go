@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"ninja/chat"
+	"time"
+)
+
+// What a text was for.
+const (
+	DeliveryCode  = "code"
+	DeliveryOrder = "order"
+)
+
+// Delivery is a text we sent and what twilio last told us about it.
+type Delivery struct {
+	Sid       string        `bson:"_id"`
+	Kind      string        `bson:"kind"`
+	User      bson.ObjectId `bson:"user"`
+	Run       bson.ObjectId `bson:"run,omitempty"`
+	To        string        `bson:"to"`
+	Text      string        `bson:"text"`
+	Status    string        `bson:"status"`
+	ErrorCode string        `bson:"error_code"`
+	Created   time.Time     `bson:"created"`
+	Updated   time.Time     `bson:"updated"`
+}
+
+// DeliveryFinal are the statuses a text doesn't move on from.
+var DeliveryFinal = []string{"delivered", "undelivered", "failed"}
+
+func deliveryFailed(status string) bool {
+	return status == "undelivered" || status == "failed"
+}
+
+// RecordDelivery remembers a text so we can follow up when it fails.
+func RecordDelivery(sid string, kind string, user *User, run *Run, text string) {
+	if sid == "" {
+		return
+	}
+
+	d := Delivery{
+		Sid:     sid,
+		Kind:    kind,
+		User:    user.Id,
+		To:      PhoneIndex(user.Phone),
+		Text:    text,
+		Status:  "queued",
+		Created: time.Now(),
+		Updated: time.Now(),
+	}
+	if run != nil {
+		d.Run = run.Id
+	}
+
+	if err := Env.Store.InsertDelivery(&d); err != nil {
+		log.Warnf("Could not record delivery of %s: %s", sid, err)
+	}
+}
+
+// SMSStatusHandler is where twilio reports on texts we sent.
+func SMSStatusHandler(w http.ResponseWriter, r *http.Request) {
+	sid := r.PostFormValue("MessageSid")
+	status := r.PostFormValue("MessageStatus")
+	code := r.PostFormValue("ErrorCode")
+
+	log.Debugf("Text %s is %s %s", sid, status, code)
+
+	previous, err := Env.Store.SetDeliveryStatus(sid, status, code, time.Now())
+	if err == ErrNotFound {
+		// not ours, or already final
+		return
+	} else if err != nil {
+		log.Warn("Could not update delivery: ", err)
+		http.Error(w, "Could not update delivery", http.StatusInternalServerError)
+		return
+	}
+
+	if deliveryFailed(status) {
+		log.Warnf("Text %s to %s %s (%s)", sid, previous.To, status, code)
+		go DeliveryFailed(previous)
+	}
+}
+
+// DeliveryFailed lets people know that a text didn't make it.
+func DeliveryFailed(d *Delivery) {
+	user, err := Env.Store.User(d.User)
+	if err != nil {
+		log.Warn("Could not load user of failed delivery: ", err)
+		return
+	}
+
+	switch d.Kind {
+	case DeliveryCode:
+		to := chat.Message{Platform: user.Platform, TeamId: user.TeamId, UserId: user.UserId}
+		msg := fmt.Sprintf("I couldn't text your code to %s, is that the right number?", user.Phone)
+		if _, err := Send(&to, chat.DirectReply(msg)); err != nil {
+			log.Warn("Could not tell user about failed code: ", err)
+		}
+	case DeliveryOrder:
+		run, err := Env.Store.Run(d.Run)
+		if err != nil {
+			log.Warn("Could not load run of failed delivery: ", err)
+			return
+		}
+		msg := fmt.Sprintf("I couldn't text %s the order, here it is again:\n```\n%s```", user.Name, d.Text)
+		if err := SendRunMessage(run, ThreadMessage(run, msg)); err != nil {
+			log.Warn("Could not resend order: ", err)
+		}
+	}
+}
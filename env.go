@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bitbucket.org/ckvist/twilio/twirest"
 	"github.com/yvasiyarov/gorelic"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"ninja/mattermost"
+	"ninja/notify"
+	"ninja/phone"
 	"ninja/slack"
 	"os"
 	"reflect"
@@ -13,30 +13,54 @@ import (
 )
 
 type EnvVars struct {
-	AppURL         string `env:"APP_URL"`
-	ForceColors    bool   `env:"FORCE_COLORS" default:"false"`
-	LogLevel       string `env:"LOG_LEVEL" default:"info"`
-	MongoDB        string `env:"MONGO_DB"`
-	MongoURL       string `env:"MONGOHQ_URL"`
-	ServerPort     string `env:"PORT" default:"3000"`
-	SlackDomain    string `env:"SLACK_DOMAIN"`
-	SlackToken     string `env:"SLACK_TOKEN"`
-	TwilioNumber   string `env:"TWILIO_NUMBER"`
-	TwilioSID      string `env:"TWILIO_SID"`
-	TwilioToken    string `env:"TWILIO_TOKEN"`
-	NewrelicKey    string `env:"NEW_RELIC_LICENSE_KEY"`
-	NewrelicDebug  bool   `env:"NEW_RELIC_DEBUG"`
-	NewrelicEnable bool   `env:"NEW_RELIC_ENABLE"`
+	AppURL                 string `env:"APP_URL"`
+	ForceColors            bool   `env:"FORCE_COLORS" default:"false"`
+	LogLevel               string `env:"LOG_LEVEL" default:"info"`
+	MongoDB                string `env:"MONGO_DB"`
+	MongoURL               string `env:"MONGOHQ_URL"`
+	StoreURL               string `env:"STORE_URL"`
+	ServerPort             string `env:"PORT" default:"3000"`
+	SlackDomain            string `env:"SLACK_DOMAIN"`
+	SlackToken             string `env:"SLACK_TOKEN"`
+	SlackAPIToken          string `env:"SLACK_API_TOKEN"`
+	SlackClientId          string `env:"SLACK_CLIENT_ID"`
+	SlackClientSecret      string `env:"SLACK_CLIENT_SECRET"`
+	SlackSigningSecret     string `env:"SLACK_SIGNING_SECRET"`
+	TwilioNumber           string `env:"TWILIO_NUMBER"`
+	TwilioSID              string `env:"TWILIO_SID"`
+	TwilioToken            string `env:"TWILIO_TOKEN"`
+	NewrelicKey            string `env:"NEW_RELIC_LICENSE_KEY"`
+	NewrelicDebug          bool   `env:"NEW_RELIC_DEBUG"`
+	NewrelicEnable         bool   `env:"NEW_RELIC_ENABLE"`
+	OutboxWorkers          int    `env:"OUTBOX_WORKERS" default:"2"`
+	MattermostURL          string `env:"MATTERMOST_URL"`
+	MattermostToken        string `env:"MATTERMOST_TOKEN"`
+	MattermostWebhookToken string `env:"MATTERMOST_WEBHOOK_TOKEN"`
+	IRCServer              string `env:"IRC_SERVER"`
+	IRCTLS                 bool   `env:"IRC_TLS"`
+	IRCNick                string `env:"IRC_NICK" default:"ninja"`
+	IRCPassword            string `env:"IRC_PASSWORD"`
+	IRCChannels            string `env:"IRC_CHANNELS"`
+	MatrixHomeserver       string `env:"MATRIX_HOMESERVER"`
+	MatrixToken            string `env:"MATRIX_TOKEN"`
+	SMTPAddr               string `env:"SMTP_ADDR"`
+	SMTPUser               string `env:"SMTP_USER"`
+	SMTPPassword           string `env:"SMTP_PASSWORD"`
+	SMTPFrom               string `env:"SMTP_FROM" default:"ninja@localhost"`
+	PhoneKeys              string `env:"PHONE_KEYS"`
+	PhoneIndexKey          string `env:"PHONE_INDEX_KEY"`
 }
 
 var Env struct {
-	Bot       *slack.Bot
-	DBSession *mgo.Session
-	TwiClient *twirest.TwilioClient
-	Vars      *EnvVars
-	Started   time.Time
-	ActiveRun *bson.ObjectId
-	NRAgent   *gorelic.Agent
+	Bot        *slack.Bot
+	Mattermost *mattermost.Adapter
+	Store      Store
+	Phone      notify.Phone
+	Notifier   *notify.Notifier
+	PhoneKeys  *phone.Keyring
+	Vars       *EnvVars
+	Started    time.Time
+	NRAgent    *gorelic.Agent
 }
 
 func LoadEnv() {
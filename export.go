@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportBatch is how many records are restored at once by import.
+const ImportBatch = 500
+
+// ExportRecord is a line of a json export, only one of the fields is set.
+// Who fetched what for whom is in the runs, there's no ledger of its own.
+type ExportRecord struct {
+	User *User `json:"user,omitempty"`
+	Run  *Run  `json:"run,omitempty"`
+}
+
+// ExportOptions are the flags of `ninja export`.
+type ExportOptions struct {
+	Format string
+	Table  string
+	Since  time.Time
+	Redact bool
+}
+
+// redact leaves out the number and its code, not whether it was verified, so
+// people aren't asked to verify again if the export is imported.
+func redact(user *User) {
+	user.Phone = ""
+	user.PhoneCode = ""
+}
+
+// csvSafe keeps spreadsheets from running what people typed as a formula,
+// e.g. a cafe called =HYPERLINK(...).
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// writeRow writes a row of cells made safe with csvSafe.
+func writeRow(out *csv.Writer, row ...string) error {
+	for i := range row {
+		row[i] = csvSafe(row[i])
+	}
+	return out.Write(row)
+}
+
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Export writes users and the runs started since opts.Since to w, one record
+// at a time. Json has everything and can be imported again, csv is one table
+// for spreadsheets.
+func Export(store Store, w io.Writer, opts ExportOptions) error {
+	if opts.Format == "json" {
+		enc := json.NewEncoder(w)
+		err := store.EachUser(func(user *User) error {
+			if opts.Redact {
+				redact(user)
+			}
+			return enc.Encode(ExportRecord{User: user})
+		})
+		if err != nil {
+			return err
+		}
+		return store.EachRun(opts.Since, func(run *Run) error {
+			return enc.Encode(ExportRecord{Run: run})
+		})
+	}
+
+	if opts.Format != "csv" {
+		return errors.New(fmt.Sprintf("Can't export %s, only json or csv", opts.Format))
+	}
+
+	out := csv.NewWriter(w)
+	switch opts.Table {
+	case "users":
+		out.Write([]string{"id", "platform", "team", "user", "name", "phone", "runner", "email"})
+		err := store.EachUser(func(user *User) error {
+			if opts.Redact {
+				redact(user)
+			}
+			return writeRow(out,
+				user.Id.Hex(), user.Platform, user.TeamId, user.UserId, user.Name,
+				user.Phone, strconv.FormatBool(user.Runner), user.Email,
+			)
+		})
+		if err != nil {
+			return err
+		}
+	case "runs", "items":
+		// runs only have the id of their runner
+		runners := map[string]string{}
+		runner := func(run *Run) string {
+			name, ok := runners[run.Runner.Hex()]
+			if !ok {
+				if user, err := store.User(run.Runner); err == nil {
+					name = user.Name
+				}
+				runners[run.Runner.Hex()] = name
+			}
+			return name
+		}
+
+		if opts.Table == "runs" {
+			out.Write([]string{"id", "platform", "team", "channel", "cafe", "runner", "started", "ended", "items"})
+		} else {
+			out.Write([]string{"run", "team", "cafe", "runner", "started", "item", "owner"})
+		}
+		err := store.EachRun(opts.Since, func(run *Run) error {
+			if opts.Table == "runs" {
+				return writeRow(out,
+					run.Id.Hex(), run.Platform, run.TeamId, run.Channel, run.Cafe, runner(run),
+					csvTime(run.Started), csvTime(run.Ended), strconv.Itoa(len(run.Items)),
+				)
+			}
+			for _, item := range run.Items {
+				err := writeRow(out, run.Id.Hex(), run.TeamId, run.Cafe, runner(run), csvTime(run.Started), item.Name, item.OwnerName)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New(fmt.Sprintf("No %s table, there's users, runs and items", opts.Table))
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// Import restores a json export into store, records that are already there
+// are replaced. It returns how many users and runs it read.
+func Import(store Store, r io.Reader) (int, int, error) {
+	users, runs := 0, 0
+	batch := Snapshot{}
+	flush := func() error {
+		if err := store.Restore(&batch); err != nil {
+			return err
+		}
+		batch = Snapshot{}
+		return nil
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		record := ExportRecord{}
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return users, runs, err
+		}
+
+		if record.User != nil {
+			batch.Users = append(batch.Users, *record.User)
+			users++
+		}
+		if record.Run != nil {
+			batch.Runs = append(batch.Runs, *record.Run)
+			runs++
+		}
+		if len(batch.Users)+len(batch.Runs) >= ImportBatch {
+			if err := flush(); err != nil {
+				return users, runs, err
+			}
+		}
+	}
+	return users, runs, flush()
+}
+
+// RunExport is `ninja export [--format json|csv] [--table users|runs|items]
+// [--since 2006-01-02] [--redact-phones]`.
+func RunExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "json", "json or csv")
+	table := flags.String("table", "items", "what to put in a csv: users, runs or items")
+	since := flags.String("since", "", "only runs started on or after this date")
+	redactPhones := flags.Bool("redact-phones", false, "leave out phone numbers")
+	flags.Parse(args)
+
+	opts := ExportOptions{Format: *format, Table: *table, Redact: *redactPhones}
+	if *since != "" {
+		date, err := time.Parse("2006-01-02", *since)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "since should look like 2006-01-02")
+			os.Exit(2)
+		}
+		opts.Since = date
+	}
+
+	store, err := OpenStore(StoreURL())
+	if err != nil {
+		log.Fatal(err)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	if err := Export(store, out, opts); err != nil {
+		log.Fatal(err)
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// RunImport is `ninja import [file]`, it reads a json export from file or
+// stdin.
+func RunImport(args []string) {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: ninja import [file]")
+		os.Exit(2)
+	}
+
+	in := os.Stdin
+	if len(args) == 1 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	store, err := OpenStore(StoreURL())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := store.Setup(); err != nil {
+		log.Fatal(err)
+	}
+	users, runs, err := Import(store, in)
+	if err != nil {
+		log.Fatalf("Imported %d users and %d runs before failing: %s", users, runs, err)
+	}
+	log.Infof("Imported %d users and %d runs", users, runs)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+// exportStore has a couple of users and runs with names people typed.
+func exportStore(t *testing.T) *MemoryStore {
+	store := NewMemoryStore()
+	bob := &User{
+		Id: bson.ObjectIdHex("5a0000000000000000000001"), Platform: "slack", TeamId: "T1", UserId: "U1", Name: "bob",
+		Phone: "+46701234567", PhoneValid: true, PhoneCode: "1234", Runner: true, Email: "bob@example.org",
+	}
+	eve := &User{
+		Id: bson.ObjectIdHex("5a0000000000000000000002"), Platform: "slack", TeamId: "T1", UserId: "U2",
+		Name: "=HYPERLINK(\"http://evil.example.org\",\"eve\")",
+	}
+	for _, u := range []*User{bob, eve} {
+		if err := store.InsertUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	started := time.Date(2026, 3, 4, 9, 30, 0, 0, time.UTC)
+	runs := []*Run{
+		{
+			Id: bson.ObjectIdHex("5b0000000000000000000001"), Platform: "slack", TeamId: "T1", Channel: "C1",
+			Runner: bob.Id, Started: started, Ended: started.Add(10 * time.Minute), Cafe: "@cafe",
+			Items: []Item{{Name: "latte", OwnerId: bob.Id, OwnerName: "bob"}, {Name: "-1+1", OwnerId: eve.Id, OwnerName: eve.Name}},
+		},
+		{
+			Id: bson.ObjectIdHex("5b0000000000000000000002"), Platform: "slack", TeamId: "T1", Channel: "C1",
+			Runner: eve.Id, Started: started.Add(time.Hour), Items: []Item{},
+		},
+	}
+	for _, run := range runs {
+		if err := store.InsertRun(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestExportRedact(t *testing.T) {
+	out := bytes.Buffer{}
+	if err := Export(exportStore(t), &out, ExportOptions{Format: "json", Redact: true}); err != nil {
+		t.Fatal(err)
+	}
+	record := ExportRecord{}
+	if err := json.NewDecoder(&out).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if got := record.User; got == nil || got.Phone != "" || got.PhoneCode != "" || !got.PhoneValid {
+		t.Errorf("exported %+v", got)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	exported := bytes.Buffer{}
+	if err := Export(exportStore(t), &exported, ExportOptions{Format: "json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := NewMemoryStore()
+	users, runs, err := Import(imported, bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users != 2 || runs != 2 {
+		t.Errorf("imported %d users and %d runs", users, runs)
+	}
+
+	again := bytes.Buffer{}
+	if err := Export(imported, &again, ExportOptions{Format: "json"}); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != exported.String() {
+		t.Errorf("exporting the import gave\n%s\ninstead of\n%s", again.String(), exported.String())
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	store := exportStore(t)
+	started := time.Date(2026, 3, 4, 9, 30, 0, 0, time.UTC)
+	first, ended, second := csvTime(started.Local()), csvTime(started.Add(10*time.Minute).Local()), csvTime(started.Add(time.Hour).Local())
+
+	golden := map[string]string{
+		"users": "id,platform,team,user,name,phone,runner,email\n" +
+			"5a0000000000000000000001,slack,T1,U1,bob,'+46701234567,true,bob@example.org\n" +
+			"5a0000000000000000000002,slack,T1,U2,\"'=HYPERLINK(\"\"http://evil.example.org\"\",\"\"eve\"\")\",,false,\n",
+		"runs": "id,platform,team,channel,cafe,runner,started,ended,items\n" +
+			"5b0000000000000000000001,slack,T1,C1,'@cafe,bob," + first + "," + ended + ",2\n" +
+			"5b0000000000000000000002,slack,T1,C1,,\"'=HYPERLINK(\"\"http://evil.example.org\"\",\"\"eve\"\")\"," + second + ",,0\n",
+		"items": "run,team,cafe,runner,started,item,owner\n" +
+			"5b0000000000000000000001,T1,'@cafe,bob," + first + ",latte,bob\n" +
+			"5b0000000000000000000001,T1,'@cafe,bob," + first + ",'-1+1,\"'=HYPERLINK(\"\"http://evil.example.org\"\",\"\"eve\"\")\"\n",
+	}
+	for table, want := range golden {
+		out := bytes.Buffer{}
+		if err := Export(store, &out, ExportOptions{Format: "csv", Table: table}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != want {
+			t.Errorf("%s came out as\n%s\ninstead of\n%s", table, out.String(), want)
+		}
+	}
+}
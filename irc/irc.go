@@ -0,0 +1,456 @@
+// Package irc connects the bot to an IRC server. It joins the configured
+// channels and treats every line said there, or to it in private, as a
+// message.
+//
+// Anyone can take any free nick, so people are known by the services account
+// they're identified with, which the server tags their lines with when it
+// has the account-tag capability. Lines from nicks that aren't identified
+// are ignored, the bot can't tell who they are.
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"ninja/chat"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Platform = "irc"
+
+// MaxLine is how much text we put in one PRIVMSG, servers cut lines at 512
+// bytes including the command and our prefix.
+const MaxLine = 400
+
+var ErrNotConnected = errors.New("Not connected to IRC")
+
+// Capabilities are what we ask the server for, account-tag tags lines with
+// the account of whoever said them and account-notify tells us when someone
+// logs in or out.
+const Capabilities = "account-tag account-notify"
+
+// Unidentified is what nicks that aren't identified with services are told.
+const Unidentified = "I only take orders from people identified with services, identify with NickServ first."
+
+// Line is a parsed IRC protocol line.
+type Line struct {
+	Tags    map[string]string
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+var tagEscapes = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+// Parse splits a raw line into its parts.
+func Parse(raw string) *Line {
+	line := Line{Tags: map[string]string{}}
+	raw = strings.TrimRight(raw, "\r\n")
+
+	if strings.HasPrefix(raw, "@") {
+		tags := raw[1:]
+		if i := strings.Index(raw, " "); i != -1 {
+			tags = raw[1:i]
+			raw = strings.TrimLeft(raw[i+1:], " ")
+		} else {
+			raw = ""
+		}
+		for _, tag := range strings.Split(tags, ";") {
+			parts := strings.SplitN(tag, "=", 2)
+			if len(parts) == 2 {
+				line.Tags[parts[0]] = tagEscapes.Replace(parts[1])
+			} else if parts[0] != "" {
+				line.Tags[parts[0]] = ""
+			}
+		}
+	}
+
+	if strings.HasPrefix(raw, ":") {
+		i := strings.Index(raw, " ")
+		if i == -1 {
+			line.Prefix = raw[1:]
+			return &line
+		}
+		line.Prefix = raw[1:i]
+		raw = strings.TrimLeft(raw[i+1:], " ")
+	}
+
+	trailing := ""
+	hasTrailing := false
+	if i := strings.Index(raw, " :"); i != -1 {
+		trailing = raw[i+2:]
+		hasTrailing = true
+		raw = raw[:i]
+	} else if strings.HasPrefix(raw, ":") {
+		trailing = raw[1:]
+		hasTrailing = true
+		raw = ""
+	}
+
+	fields := strings.Fields(raw)
+	if len(fields) > 0 {
+		line.Command = strings.ToUpper(fields[0])
+		line.Params = fields[1:]
+	}
+	if hasTrailing {
+		line.Params = append(line.Params, trailing)
+	}
+
+	return &line
+}
+
+// Nick is the nick part of the prefix.
+func (l *Line) Nick() string {
+	if i := strings.Index(l.Prefix, "!"); i != -1 {
+		return l.Prefix[:i]
+	}
+	return l.Prefix
+}
+
+type Adapter struct {
+	// Server is the host:port to connect to.
+	Server   string
+	TLS      bool
+	Nick     string
+	Password string
+	Channels []string
+	// Throttle is the least time between lines we send, servers kick
+	// clients that flood them.
+	Throttle time.Duration
+	// Dial connects to the server, defaults to net.Dial or tls.Dial.
+	Dial func(network string, address string) (net.Conn, error)
+
+	messages chat.MessageHandler
+
+	sync.Mutex
+	conn net.Conn
+	nick string
+	// nicks maps accounts to the nick they last used, so replies reach
+	// them after a nick change.
+	nicks    map[string]string
+	nextLine time.Time
+}
+
+func (a *Adapter) Platform() string {
+	return Platform
+}
+
+// Receive sets the message handler, IRC has no reactions.
+func (a *Adapter) Receive(messages chat.MessageHandler, reactions chat.ReactionHandler) {
+	a.messages = messages
+}
+
+func (a *Adapter) dial() (net.Conn, error) {
+	if a.Dial != nil {
+		return a.Dial("tcp", a.Server)
+	}
+	if a.TLS {
+		return tls.Dial("tcp", a.Server, nil)
+	}
+	return net.Dial("tcp", a.Server)
+}
+
+// Run keeps us connected, reconnecting with a growing delay when the
+// connection drops.
+func (a *Adapter) Run() {
+	delay := time.Second
+	for {
+		started := time.Now()
+		err := a.Connect()
+		if time.Since(started) > 5*time.Minute {
+			delay = time.Second
+		}
+		log.Warnf("Lost connection to %s, reconnecting in %s: %v", a.Server, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > 5*time.Minute {
+			delay = 5 * time.Minute
+		}
+	}
+}
+
+// Connect connects to the server and handles it until the connection
+// drops.
+func (a *Adapter) Connect() error {
+	conn, err := a.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	a.Lock()
+	a.conn = conn
+	a.nick = a.Nick
+	a.nicks = make(map[string]string)
+	a.Unlock()
+
+	defer func() {
+		a.Lock()
+		a.conn = nil
+		a.Unlock()
+	}()
+
+	log.Infof("Connected to %s as %s", a.Server, a.Nick)
+
+	// the server waits with registering us until CAP END
+	a.send("CAP REQ :" + Capabilities)
+	if a.Password != "" {
+		a.send("PASS " + a.Password)
+	}
+	a.send("NICK " + a.Nick)
+	a.send("USER " + a.Nick + " 0 * :Coffee Ninja")
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		a.handle(Parse(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("Connection closed")
+}
+
+func (a *Adapter) handle(line *Line) {
+	switch line.Command {
+	case "PING":
+		a.send("PONG :" + strings.Join(line.Params, " "))
+	case "CAP":
+		if len(line.Params) > 1 && line.Params[1] == "NAK" {
+			log.Warnf("%s doesn't have %s, nobody can be identified so every message is ignored", a.Server, Capabilities)
+		}
+		if len(line.Params) > 1 && (line.Params[1] == "ACK" || line.Params[1] == "NAK") {
+			a.send("CAP END")
+		}
+	case "001":
+		channels := []string{}
+		for _, channel := range a.Channels {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				channels = append(channels, channel)
+			}
+		}
+		if len(channels) > 0 {
+			a.send("JOIN " + strings.Join(channels, ","))
+		}
+	case "433":
+		// nick taken, try with an underscore
+		a.Lock()
+		a.nick += "_"
+		nick := a.nick
+		a.Unlock()
+		a.send("NICK " + nick)
+	case "NICK":
+		if len(line.Params) > 0 {
+			a.renamed(line.Nick(), line.Params[0])
+		}
+	case "ACCOUNT":
+		// * is a logout
+		if len(line.Params) > 0 {
+			a.identified(line.Nick(), line.Params[0])
+		}
+	case "QUIT":
+		a.identified(line.Nick(), "*")
+	case "PRIVMSG":
+		if len(line.Params) > 1 {
+			a.privmsg(line.Nick(), line.Tags["account"], line.Params[0], line.Params[1])
+		}
+	}
+}
+
+func (a *Adapter) renamed(from string, to string) {
+	a.Lock()
+	defer a.Unlock()
+	if strings.EqualFold(from, a.nick) {
+		a.nick = to
+		return
+	}
+	for id, nick := range a.nicks {
+		if strings.EqualFold(nick, from) {
+			a.nicks[id] = to
+		}
+	}
+}
+
+// identified notes that nick is now using account, or nothing when account
+// is *, so nothing is sent to a nick someone else may have taken.
+func (a *Adapter) identified(nick string, account string) {
+	a.Lock()
+	defer a.Unlock()
+	if a.nicks == nil {
+		a.nicks = make(map[string]string)
+	}
+	for id, n := range a.nicks {
+		if strings.EqualFold(n, nick) {
+			delete(a.nicks, id)
+		}
+	}
+	if account != "*" && account != "" {
+		a.nicks[UserId(account)] = nick
+	}
+}
+
+// UserId is the user id of a services account, accounts are case
+// insensitive.
+func UserId(account string) string {
+	return strings.ToLower(account)
+}
+
+// NickOf returns the current nick of the user with id.
+func (a *Adapter) NickOf(id string) string {
+	a.Lock()
+	defer a.Unlock()
+	if nick, ok := a.nicks[id]; ok {
+		return nick
+	}
+	return id
+}
+
+// Mention is the nick, clients highlight lines with it.
+func (a *Adapter) Mention(userId string, username string) string {
+	return a.NickOf(userId)
+}
+
+func isChannel(target string) bool {
+	return strings.IndexAny(target, "#&+!") == 0
+}
+
+func (a *Adapter) privmsg(from string, account string, target string, text string) {
+	if strings.HasPrefix(text, "\x01") {
+		// CTCP
+		return
+	}
+
+	a.Lock()
+	nick := a.nick
+	a.Unlock()
+
+	// people address the bot by nick in channels
+	addressed := !isChannel(target)
+	for _, sep := range []string{":", ","} {
+		if len(text) > len(nick) && strings.EqualFold(text[:len(nick)], nick) && strings.HasPrefix(text[len(nick):], sep) {
+			text = text[len(nick)+1:]
+			addressed = true
+			break
+		}
+	}
+
+	if a.messages == nil {
+		return
+	}
+
+	if account == "" {
+		if addressed {
+			if err := a.send("NOTICE " + from + " :" + Unidentified); err != nil {
+				log.Warn("Could not send reply: ", err)
+			}
+		}
+		return
+	}
+	a.identified(from, account)
+
+	m := chat.Message{
+		Platform:  Platform,
+		TeamId:    a.Server,
+		ChannelId: target,
+		Direct:    !isChannel(target),
+		UserId:    UserId(account),
+		UserName:  from,
+		Text:      strings.TrimSpace(text),
+	}
+	if m.Direct {
+		m.ChannelId = from
+	}
+
+	go func() {
+		if reply := a.messages(&m); reply != nil {
+			if _, err := a.Send(&m, reply); err != nil {
+				log.Warn("Could not send reply: ", err)
+			}
+		}
+	}()
+}
+
+func (a *Adapter) send(line string) error {
+	a.Lock()
+	conn := a.conn
+	wait := time.Duration(0)
+	if a.Throttle > 0 {
+		now := time.Now()
+		if a.nextLine.After(now) {
+			wait = a.nextLine.Sub(now)
+		} else {
+			a.nextLine = now
+		}
+		a.nextLine = a.nextLine.Add(a.Throttle)
+	}
+	a.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	time.Sleep(wait)
+	_, err := conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// split breaks text into lines that fit in a PRIVMSG. IRC has no code
+// blocks so their fences are dropped.
+func split(text string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(strings.Replace(line, "```", "", -1))
+		for len(line) > MaxLine {
+			cut := MaxLine
+			for cut > 0 && line[cut]&0xC0 == 0x80 {
+				cut--
+			}
+			lines = append(lines, line[:cut])
+			line = line[cut:]
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Send says reply in the channel. Ephemeral replies become notices to the
+// user since that's as private as IRC gets. There are no threads or message
+// ids, so the returned id is always empty.
+func (a *Adapter) Send(to *chat.Message, reply *chat.Reply) (string, error) {
+	command := "PRIVMSG"
+	target := to.ChannelId
+
+	switch {
+	case reply.Visibility == chat.Ephemeral:
+		command = "NOTICE"
+		target = a.NickOf(to.UserId)
+	case reply.Visibility == chat.Direct || to.Direct:
+		target = a.NickOf(to.UserId)
+	}
+
+	if target == "" {
+		return "", errors.New("No channel to send to")
+	}
+
+	for _, line := range split(reply.Text) {
+		if err := a.send(command + " " + target + " :" + line); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// LookupUser isn't supported, IRC users only have a nick.
+func (a *Adapter) LookupUser(teamId string, userId string) (*chat.Profile, error) {
+	return nil, chat.ErrUnsupported
+}
+
+// ChannelMembers isn't supported, NAMES only has nicks and users are their
+// accounts.
+func (a *Adapter) ChannelMembers(teamId string, channelId string) ([]chat.Profile, error) {
+	return nil, chat.ErrUnsupported
+}
@@ -0,0 +1,170 @@
+package irc
+
+import (
+	"bufio"
+	"net"
+	"ninja/chat"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer is the server end of a connection the adapter dialed.
+type fakeServer struct {
+	t     *testing.T
+	conn  net.Conn
+	lines *bufio.Reader
+}
+
+func (s *fakeServer) say(line string) {
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+		s.t.Fatalf("saying %q: %s", line, err)
+	}
+}
+
+func (s *fakeServer) expect(want string) {
+	s.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := s.lines.ReadString('\n')
+	if err != nil {
+		s.t.Fatalf("waiting for %q: %s", want, err)
+	}
+	if got := strings.TrimRight(line, "\r\n"); got != want {
+		s.t.Fatalf("got %q instead of %q", got, want)
+	}
+}
+
+// connect starts a with a fake server on the other end of a pipe.
+func connect(t *testing.T, a *Adapter) (*fakeServer, chan error) {
+	client, server := net.Pipe()
+	a.Dial = func(network string, address string) (net.Conn, error) {
+		return client, nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- a.Connect() }()
+	return &fakeServer{t: t, conn: server, lines: bufio.NewReader(server)}, done
+}
+
+// register goes through what the adapter says when it connects.
+func (s *fakeServer) register() {
+	s.expect("CAP REQ :account-tag account-notify")
+	s.expect("NICK ninja")
+	s.expect("USER ninja 0 * :Coffee Ninja")
+	s.say(":irc.example.org CAP * ACK :account-tag account-notify")
+	s.expect("CAP END")
+}
+
+func TestParse(t *testing.T) {
+	line := Parse("@time=2020;account=Bob\\sSmith;draft/x :bob!b@example.org PRIVMSG #coffee :ninja: order a latte\r\n")
+	if line.Nick() != "bob" || line.Command != "PRIVMSG" || len(line.Params) != 2 ||
+		line.Params[0] != "#coffee" || line.Params[1] != "ninja: order a latte" {
+		t.Errorf("parsed %+v", line)
+	}
+	if line.Tags["account"] != "Bob Smith" || line.Tags["time"] != "2020" || len(line.Tags) != 3 {
+		t.Errorf("parsed the tags as %q", line.Tags)
+	}
+	if line := Parse("PING :abc"); line.Command != "PING" || len(line.Params) != 1 || line.Params[0] != "abc" {
+		t.Errorf("parsed %+v", line)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	messages := make(chan *chat.Message, 1)
+	a := &Adapter{Server: "irc.example.org:6667", Nick: "ninja", Channels: []string{"#coffee", " #tea"}}
+	a.Receive(func(m *chat.Message) *chat.Reply {
+		messages <- m
+		return chat.NewReply("hi " + m.UserName)
+	}, nil)
+
+	server, done := connect(t, a)
+	server.register()
+
+	server.say("PING :irc.example.org")
+	server.expect("PONG :irc.example.org")
+
+	server.say(":irc.example.org 001 ninja :Welcome")
+	server.expect("JOIN #coffee,#tea")
+
+	server.say("@account=Bob :bob!b@example.org PRIVMSG #coffee :ninja: help")
+	server.expect("PRIVMSG #coffee :hi bob")
+	m := <-messages
+	if m.Text != "help" || m.ChannelId != "#coffee" || m.Direct || m.UserId != "bob" || m.TeamId != a.Server {
+		t.Errorf("got %+v", m)
+	}
+
+	// the account follows a nick change
+	server.say(":bob!b@example.org NICK Robert")
+	server.say("@account=bob :Robert!b@example.org PRIVMSG ninja :order a latte")
+	server.expect("PRIVMSG Robert :hi Robert")
+	m = <-messages
+	if m.Text != "order a latte" || !m.Direct || m.ChannelId != "Robert" || m.UserId != "bob" {
+		t.Errorf("got %+v", m)
+	}
+
+	// pipes don't buffer, so the server has to be reading while we send
+	sent := make(chan error, 1)
+	go func() {
+		_, err := a.Send(m, chat.EphemeralReply("psst"))
+		sent <- err
+	}()
+	server.expect("NOTICE Robert :psst")
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	// once they log out their nick isn't theirs anymore
+	server.say(":Robert!b@example.org ACCOUNT *")
+	server.say("PING :after")
+	server.expect("PONG :after")
+	if nick := a.NickOf("bob"); nick != "bob" {
+		t.Errorf("logged out user is still %s", nick)
+	}
+
+	server.conn.Close()
+	if err := <-done; err == nil {
+		t.Error("Connect returned without an error after the connection dropped")
+	}
+	if _, err := a.Send(m, chat.NewReply("anyone?")); err != ErrNotConnected {
+		t.Errorf("Send after the connection dropped: %v", err)
+	}
+}
+
+func TestNickTaken(t *testing.T) {
+	a := &Adapter{Server: "irc.example.org:6667", Nick: "ninja"}
+	server, done := connect(t, a)
+	server.register()
+
+	server.say(":irc.example.org 433 * ninja :Nickname is already in use")
+	server.expect("NICK ninja_")
+
+	server.conn.Close()
+	<-done
+}
+
+func TestUnidentified(t *testing.T) {
+	handled := false
+	a := &Adapter{Server: "irc.example.org:6667", Nick: "ninja"}
+	a.Receive(func(m *chat.Message) *chat.Reply {
+		handled = true
+		return nil
+	}, nil)
+
+	server, done := connect(t, a)
+	server.register()
+
+	// anyone can take a nick, without an account it's nobody
+	server.say(":alice!a@example.org PRIVMSG #coffee :ninja: forgetme confirm")
+	server.expect("NOTICE alice :" + Unidentified)
+	server.say(":alice!a@example.org PRIVMSG ninja :order a latte")
+	server.expect("NOTICE alice :" + Unidentified)
+	// lines that aren't for the bot are left alone
+	server.say(":alice!a@example.org PRIVMSG #coffee :morning")
+	server.say("PING :done")
+	server.expect("PONG :done")
+
+	server.conn.Close()
+	<-done
+	if handled {
+		t.Error("a message from a nick that isn't identified was handled")
+	}
+}
@@ -5,6 +5,8 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/yvasiyarov/gorelic"
 	"math/rand"
+	"ninja/notify"
+	"os"
 	"time"
 )
 
@@ -20,7 +22,36 @@ func main() {
 	}
 	log.SetLevel(level)
 
-	Env.TwiClient = twirest.NewClient(Env.Vars.TwilioSID, Env.Vars.TwilioToken)
+	SetupPhoneKeys()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "console":
+			RunConsole(os.Args[2:])
+			return
+		case "migrate":
+			RunMigrate(os.Args[2:])
+			return
+		case "export":
+			RunExport(os.Args[2:])
+			return
+		case "import":
+			RunImport(os.Args[2:])
+			return
+		case "rekey":
+			RunRekey()
+			return
+		case "copy-store":
+			RunCopyStore(os.Args[2:])
+			return
+		}
+	}
+
+	phone := &notify.Twilio{Client: twirest.NewClient(Env.Vars.TwilioSID, Env.Vars.TwilioToken)}
+	if Env.Vars.AppURL != "" {
+		phone.StatusCallback = Env.Vars.AppURL + "/sms/status"
+	}
+	SetupNotifier(phone)
 
 	if Env.Vars.NewrelicEnable {
 		Env.NRAgent = gorelic.NewAgent()
@@ -29,7 +60,7 @@ func main() {
 		Env.NRAgent.Run()
 	}
 
-	go SetupDatabase()
+	SetupDatabase()
 	SetupBot()
 	SetupWeb()
 }
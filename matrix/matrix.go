@@ -0,0 +1,443 @@
+// Package matrix connects the bot to a Matrix homeserver through the client
+// server api. It long polls /sync for room messages and joins rooms it's
+// invited to.
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"ninja/chat"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Platform = "matrix"
+
+// SyncTimeout is how long the homeserver holds on to a sync request when
+// there's nothing new.
+const SyncTimeout = 30 * time.Second
+
+type Adapter struct {
+	// Homeserver is the base url of the server, e.g. https://matrix.org
+	Homeserver string
+	// Token is the access token of the bot account.
+	Token string
+	// Client is used for requests to the homeserver, it needs a timeout
+	// longer than SyncTimeout.
+	Client *http.Client
+
+	messages chat.MessageHandler
+
+	sync.Mutex
+	userId  string
+	since   string
+	members map[string]int
+	direct  map[string]string
+	txn     int64
+}
+
+var defaultClient = &http.Client{Timeout: SyncTimeout + 15*time.Second}
+
+func (a *Adapter) Platform() string {
+	return Platform
+}
+
+// Receive sets the message handler, reactions aren't supported yet.
+func (a *Adapter) Receive(messages chat.MessageHandler, reactions chat.ReactionHandler) {
+	a.messages = messages
+}
+
+// TeamId is the host of the homeserver, everyone on it is one team.
+func (a *Adapter) TeamId() string {
+	u, err := url.Parse(a.Homeserver)
+	if err != nil {
+		return a.Homeserver
+	}
+	return u.Host
+}
+
+type apiError struct {
+	ErrCode      string `json:"errcode"`
+	Error        string `json:"error"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+func (a *Adapter) api(method string, path string, body interface{}, result interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		out, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewBuffer(out)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(a.Homeserver, "/")+"/_matrix/client/v3"+path, payload)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := a.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e apiError
+		json.NewDecoder(resp.Body).Decode(&e)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			retry := time.Duration(e.RetryAfterMs) * time.Millisecond
+			if retry <= 0 {
+				retry = time.Second
+			}
+			return &chat.RateLimitError{RetryAfter: retry}
+		}
+		return errors.New(fmt.Sprintf("%s %s failed with %d: %s %s", method, path, resp.StatusCode, e.ErrCode, e.Error))
+	}
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// UserId is the id of the bot account.
+func (a *Adapter) UserId() (string, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.userId != "" {
+		return a.userId, nil
+	}
+
+	var whoami struct {
+		UserId string `json:"user_id"`
+	}
+	if err := a.api("GET", "/account/whoami", nil, &whoami); err != nil {
+		return "", err
+	}
+	a.userId = whoami.UserId
+	return a.userId, nil
+}
+
+type event struct {
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+	EventId string `json:"event_id"`
+	Content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+	} `json:"content"`
+}
+
+type syncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Summary struct {
+				JoinedMemberCount *int `json:"m.joined_member_count"`
+			} `json:"summary"`
+			Timeline struct {
+				Events []event `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// Run syncs until the process exits, backing off when the homeserver is
+// unhappy.
+func (a *Adapter) Run() {
+	delay := time.Second
+	for {
+		if err := a.Sync(); err != nil {
+			if limited, ok := err.(*chat.RateLimitError); ok && limited.RetryAfter > delay {
+				delay = limited.RetryAfter
+			}
+			log.Warnf("Matrix sync failed, retrying in %s: %s", delay, err)
+			time.Sleep(delay)
+			if delay *= 2; delay > 5*time.Minute {
+				delay = 5 * time.Minute
+			}
+			continue
+		}
+		delay = time.Second
+	}
+}
+
+// Sync fetches and handles whatever happened since the last sync. Messages
+// sent before the first sync are skipped so we don't answer old commands
+// after a restart.
+func (a *Adapter) Sync() error {
+	me, err := a.UserId()
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	since := a.since
+	a.Unlock()
+
+	query := url.Values{}
+	query.Set("timeout", strconv.Itoa(int(SyncTimeout/time.Millisecond)))
+	if since != "" {
+		query.Set("since", since)
+	}
+
+	var resp syncResponse
+	if err := a.api("GET", "/sync?"+query.Encode(), nil, &resp); err != nil {
+		return err
+	}
+
+	for room := range resp.Rooms.Invite {
+		log.Infof("Joining %s", room)
+		if err := a.api("POST", "/join/"+url.PathEscape(room), struct{}{}, nil); err != nil {
+			log.Warnf("Could not join %s: %s", room, err)
+		}
+	}
+
+	a.Lock()
+	if a.members == nil {
+		a.members = make(map[string]int)
+	}
+	for room, joined := range resp.Rooms.Join {
+		if joined.Summary.JoinedMemberCount != nil {
+			a.members[room] = *joined.Summary.JoinedMemberCount
+		}
+	}
+	a.since = resp.NextBatch
+	a.Unlock()
+
+	if since == "" {
+		return nil
+	}
+
+	for room, joined := range resp.Rooms.Join {
+		for _, e := range joined.Timeline.Events {
+			if e.Type != "m.room.message" || e.Content.MsgType != "m.text" || e.Sender == me {
+				continue
+			}
+			a.dispatch(room, &e, me)
+		}
+	}
+
+	return nil
+}
+
+// localpart is the name part of a user id like @ninja:example.org.
+func localpart(userId string) string {
+	name := strings.TrimPrefix(userId, "@")
+	if i := strings.Index(name, ":"); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// body strips the quote of the message being replied to and the bot being
+// addressed from the text of a message.
+func body(text string, me string) string {
+	lines := strings.Split(text, "\n")
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "> ") {
+		lines = lines[1:]
+	}
+	text = strings.TrimSpace(strings.Join(lines, "\n"))
+
+	name := localpart(me)
+	for _, prefix := range []string{me + ":", name + ":", name + ","} {
+		if len(text) > len(prefix) && strings.EqualFold(text[:len(prefix)], prefix) {
+			return strings.TrimSpace(text[len(prefix):])
+		}
+	}
+	return text
+}
+
+func (a *Adapter) dispatch(room string, e *event, me string) {
+	a.Lock()
+	direct := a.members[room] == 2
+	a.Unlock()
+
+	m := chat.Message{
+		Platform:  Platform,
+		TeamId:    a.TeamId(),
+		ChannelId: room,
+		Direct:    direct,
+		UserId:    e.Sender,
+		UserName:  localpart(e.Sender),
+		Text:      body(e.Content.Body, me),
+		Id:        e.EventId,
+	}
+
+	if a.messages == nil {
+		return
+	}
+
+	if reply := a.messages(&m); reply != nil {
+		if _, err := a.Send(&m, reply); err != nil {
+			log.Warn("Could not send reply: ", err)
+		}
+	}
+}
+
+func (a *Adapter) nextTxn() string {
+	a.Lock()
+	defer a.Unlock()
+	if a.txn == 0 {
+		a.txn = time.Now().UnixNano()
+	}
+	a.txn++
+	return strconv.FormatInt(a.txn, 10)
+}
+
+type relation struct {
+	RelType string `json:"rel_type"`
+	EventId string `json:"event_id"`
+}
+
+type content struct {
+	MsgType   string    `json:"msgtype"`
+	Body      string    `json:"body"`
+	RelatesTo *relation `json:"m.relates_to,omitempty"`
+}
+
+func (a *Adapter) post(room string, c *content) (string, error) {
+	var sent struct {
+		EventId string `json:"event_id"`
+	}
+	path := "/rooms/" + url.PathEscape(room) + "/send/m.room.message/" + a.nextTxn()
+	if err := a.api("PUT", path, c, &sent); err != nil {
+		return "", err
+	}
+	return sent.EventId, nil
+}
+
+// directRoom finds or creates a direct message room with userId.
+func (a *Adapter) directRoom(userId string) (string, error) {
+	a.Lock()
+	room, ok := a.direct[userId]
+	a.Unlock()
+	if ok {
+		return room, nil
+	}
+
+	request := struct {
+		IsDirect bool     `json:"is_direct"`
+		Invite   []string `json:"invite"`
+		Preset   string   `json:"preset"`
+	}{true, []string{userId}, "trusted_private_chat"}
+
+	var created struct {
+		RoomId string `json:"room_id"`
+	}
+	if err := a.api("POST", "/createRoom", &request, &created); err != nil {
+		return "", err
+	}
+
+	a.Lock()
+	if a.direct == nil {
+		a.direct = make(map[string]string)
+	}
+	a.direct[userId] = created.RoomId
+	if a.members == nil {
+		a.members = make(map[string]int)
+	}
+	a.members[created.RoomId] = 2
+	a.Unlock()
+
+	return created.RoomId, nil
+}
+
+// Send posts reply to the room of to. Matrix has no ephemeral messages, so
+// those go to a direct room as notices, and broadcasts go to the room
+// instead of the thread.
+func (a *Adapter) Send(to *chat.Message, reply *chat.Reply) (string, error) {
+	c := content{MsgType: "m.text", Body: reply.Text}
+	room := to.ChannelId
+
+	if reply.Visibility == chat.Ephemeral {
+		c.MsgType = "m.notice"
+	}
+	if reply.Visibility != chat.Channel && !to.Direct {
+		// everyone in the room would see it
+		var err error
+		if room, err = a.directRoom(to.UserId); err != nil {
+			return "", err
+		}
+	}
+
+	if room == "" {
+		return "", errors.New("No room to send to")
+	}
+
+	if reply.ThreadId != "" && !reply.Broadcast && room == to.ChannelId {
+		c.RelatesTo = &relation{RelType: "m.thread", EventId: reply.ThreadId}
+	}
+
+	return a.post(room, &c)
+}
+
+func (a *Adapter) LookupUser(teamId string, userId string) (*chat.Profile, error) {
+	var profile struct {
+		DisplayName string `json:"displayname"`
+		AvatarURL   string `json:"avatar_url"`
+	}
+	if err := a.api("GET", "/profile/"+url.PathEscape(userId), nil, &profile); err != nil {
+		return nil, err
+	}
+
+	return &chat.Profile{
+		Id:          userId,
+		Name:        localpart(userId),
+		DisplayName: profile.DisplayName,
+		Avatar:      profile.AvatarURL,
+	}, nil
+}
+
+func (a *Adapter) ChannelMembers(teamId string, channelId string) ([]chat.Profile, error) {
+	me, err := a.UserId()
+	if err != nil {
+		return nil, err
+	}
+
+	var members struct {
+		Joined map[string]struct {
+			DisplayName string `json:"display_name"`
+		} `json:"joined"`
+	}
+	if err := a.api("GET", "/rooms/"+url.PathEscape(channelId)+"/joined_members", nil, &members); err != nil {
+		return nil, err
+	}
+
+	profiles := []chat.Profile{}
+	for id, member := range members.Joined {
+		if id != me {
+			profiles = append(profiles, chat.Profile{Id: id, Name: localpart(id), DisplayName: member.DisplayName})
+		}
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Id < profiles[j].Id })
+	return profiles, nil
+}
+
+// Mention is the full user id, clients highlight messages containing it.
+func (a *Adapter) Mention(userId string, username string) string {
+	return userId
+}
@@ -0,0 +1,208 @@
+package matrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"ninja/chat"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const room = "!coffee:example.org"
+
+func message(sender string, id string, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "m.room.message",
+		"sender":   sender,
+		"event_id": id,
+		"content":  map[string]string{"msgtype": "m.text", "body": text},
+	}
+}
+
+// homeserver is a fake that hands out syncs one after another and keeps
+// what was sent and joined.
+type homeserver struct {
+	t *testing.T
+
+	sync.Mutex
+	syncs  []map[string]interface{}
+	since  []string
+	sent   []content
+	sentTo []string
+	joined []string
+}
+
+func (h *homeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(apiError{ErrCode: "M_UNKNOWN_TOKEN"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/client/v3")
+	switch {
+	case r.Method == "GET" && path == "/account/whoami":
+		json.NewEncoder(w).Encode(map[string]string{"user_id": "@ninja:example.org"})
+	case r.Method == "GET" && path == "/sync":
+		h.since = append(h.since, r.URL.Query().Get("since"))
+		if len(h.syncs) == 0 {
+			json.NewEncoder(w).Encode(map[string]string{"next_batch": "end"})
+			return
+		}
+		json.NewEncoder(w).Encode(h.syncs[0])
+		h.syncs = h.syncs[1:]
+	case r.Method == "GET" && path == "/rooms/"+room+"/joined_members":
+		json.NewEncoder(w).Encode(map[string]interface{}{"joined": map[string]interface{}{
+			"@ninja:example.org": map[string]string{"display_name": "Coffee Ninja"},
+			"@bob:example.org":   map[string]string{"display_name": "Bob"},
+			"@alice:example.org": map[string]string{},
+		}})
+	case r.Method == "POST" && strings.HasPrefix(path, "/join/"):
+		h.joined = append(h.joined, strings.TrimPrefix(path, "/join/"))
+		json.NewEncoder(w).Encode(map[string]string{"room_id": strings.TrimPrefix(path, "/join/")})
+	case r.Method == "POST" && path == "/createRoom":
+		json.NewEncoder(w).Encode(map[string]string{"room_id": "!dm:example.org"})
+	case r.Method == "PUT" && strings.HasPrefix(path, "/rooms/") && strings.Contains(path, "/send/m.room.message/"):
+		c := content{}
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			h.t.Error(err)
+		}
+		h.sent = append(h.sent, c)
+		h.sentTo = append(h.sentTo, strings.Split(strings.TrimPrefix(path, "/rooms/"), "/")[0])
+		json.NewEncoder(w).Encode(map[string]string{"event_id": "$sent"})
+	default:
+		h.t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func joined(events ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		room: map[string]interface{}{
+			"summary":  map[string]int{"m.joined_member_count": 3},
+			"timeline": map[string]interface{}{"events": events},
+		},
+	}
+}
+
+func TestSync(t *testing.T) {
+	h := &homeserver{t: t, syncs: []map[string]interface{}{
+		{
+			"next_batch": "s1",
+			"rooms": map[string]interface{}{
+				"join":   joined(message("@bob:example.org", "$old", "ninja: startrun")),
+				"invite": map[string]interface{}{"!tea:example.org": map[string]interface{}{}},
+			},
+		},
+		{
+			"next_batch": "s2",
+			"rooms": map[string]interface{}{
+				"join": joined(
+					message("@bob:example.org", "$new", "ninja: help"),
+					message("@ninja:example.org", "$mine", "ninja: help"),
+				),
+			},
+		},
+	}}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	got := []*chat.Message{}
+	a := &Adapter{Homeserver: server.URL, Token: "token"}
+	a.Receive(func(m *chat.Message) *chat.Reply {
+		got = append(got, m)
+		return chat.NewReply("hi")
+	}, nil)
+
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("answered messages from before the first sync: %+v", got)
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if len(h.since) != 2 || h.since[0] != "" || h.since[1] != "s1" {
+		t.Errorf("synced since %q", h.since)
+	}
+	if len(h.joined) != 1 || h.joined[0] != "!tea:example.org" {
+		t.Errorf("joined %q", h.joined)
+	}
+	if len(got) != 1 {
+		t.Fatalf("handled %d messages instead of 1", len(got))
+	}
+	m := got[0]
+	if m.Text != "help" || m.UserId != "@bob:example.org" || m.UserName != "bob" || m.ChannelId != room ||
+		m.Direct || m.TeamId != strings.TrimPrefix(server.URL, "http://") {
+		t.Errorf("handled %+v", m)
+	}
+	if len(h.sent) != 1 || h.sent[0].Body != "hi" || h.sent[0].MsgType != "m.text" {
+		t.Errorf("sent %+v", h.sent)
+	}
+}
+
+func TestSend(t *testing.T) {
+	h := &homeserver{t: t}
+	server := httptest.NewServer(h)
+	defer server.Close()
+	a := &Adapter{Homeserver: server.URL, Token: "token"}
+	to := &chat.Message{Platform: Platform, ChannelId: room, UserId: "@bob:example.org"}
+
+	id, err := a.Send(to, &chat.Reply{Text: "in the thread", ThreadId: "$run"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "$sent" {
+		t.Errorf("Send returned %q", id)
+	}
+	ephemeral := chat.EphemeralReply("psst")
+	ephemeral.ThreadId = "$run"
+	if _, err := a.Send(to, ephemeral); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if len(h.sent) != 2 {
+		t.Fatalf("sent %+v", h.sent)
+	}
+	if r := h.sent[0].RelatesTo; r == nil || r.RelType != "m.thread" || r.EventId != "$run" || h.sentTo[0] != room {
+		t.Errorf("thread reply relates to %+v in %s", r, h.sentTo[0])
+	}
+	// the room would see a notice, it goes to them alone
+	if h.sentTo[1] != "!dm:example.org" || h.sent[1].MsgType != "m.notice" || h.sent[1].RelatesTo != nil {
+		t.Errorf("ephemeral reply was sent as %+v to %s", h.sent[1], h.sentTo[1])
+	}
+}
+
+func TestChannelMembers(t *testing.T) {
+	server := httptest.NewServer(&homeserver{t: t})
+	defer server.Close()
+	a := &Adapter{Homeserver: server.URL, Token: "token"}
+
+	members, err := a.ChannelMembers("", room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []chat.Profile{
+		{Id: "@alice:example.org", Name: "alice"},
+		{Id: "@bob:example.org", Name: "bob", DisplayName: "Bob"},
+	}
+	if len(members) != len(want) {
+		t.Fatalf("members are %+v", members)
+	}
+	for i := range want {
+		if members[i] != want[i] {
+			t.Errorf("member %d is %+v instead of %+v", i, members[i], want[i])
+		}
+	}
+}
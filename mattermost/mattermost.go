@@ -0,0 +1,415 @@
+// Package mattermost connects the bot to a Mattermost server. Messages come
+// in through outgoing webhooks and slash commands, everything the bot says
+// outside of a direct response goes through the REST api.
+package mattermost
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"net/http"
+	"ninja/chat"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Platform = "mattermost"
+
+// Incoming is what outgoing webhooks and slash commands post to us.
+type Incoming struct {
+	Token       string `json:"token"`
+	TeamId      string `json:"team_id"`
+	TeamDomain  string `json:"team_domain"`
+	ChannelId   string `json:"channel_id"`
+	ChannelName string `json:"channel_name"`
+	Timestamp   int64  `json:"timestamp"`
+	UserId      string `json:"user_id"`
+	UserName    string `json:"user_name"`
+	PostId      string `json:"post_id"`
+	Text        string `json:"text"`
+	TriggerWord string `json:"trigger_word"`
+	Command     string `json:"command"`
+}
+
+// IsDirect reports whether the message was sent in a direct message
+// channel, those are named after the two users in them.
+func (in *Incoming) IsDirect() bool {
+	return strings.Contains(in.ChannelName, "__")
+}
+
+type response struct {
+	Text         string `json:"text"`
+	ResponseType string `json:"response_type,omitempty"`
+}
+
+type Adapter struct {
+	// URL of the server, e.g. https://chat.example.com
+	URL string
+	// Token is the access token of the bot account.
+	Token string
+	// WebhookToken is the token outgoing webhooks and slash commands are
+	// sent with, requests with any other token are refused.
+	WebhookToken string
+	// Client is used for requests to the server, defaults to a client with
+	// a short timeout.
+	Client *http.Client
+
+	messages chat.MessageHandler
+
+	sync.Mutex
+	botUserId string
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (a *Adapter) Platform() string {
+	return Platform
+}
+
+// Receive sets the message handler, reactions don't reach outgoing
+// webhooks so there's nothing to pass to the other one.
+func (a *Adapter) Receive(messages chat.MessageHandler, reactions chat.ReactionHandler) {
+	a.messages = messages
+}
+
+func decodeIncoming(r *http.Request) (*Incoming, error) {
+	var in Incoming
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&in)
+		return &in, err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	in.Token = r.PostForm.Get("token")
+	in.TeamId = r.PostForm.Get("team_id")
+	in.TeamDomain = r.PostForm.Get("team_domain")
+	in.ChannelId = r.PostForm.Get("channel_id")
+	in.ChannelName = r.PostForm.Get("channel_name")
+	in.Timestamp, _ = strconv.ParseInt(r.PostForm.Get("timestamp"), 10, 64)
+	in.UserId = r.PostForm.Get("user_id")
+	in.UserName = r.PostForm.Get("user_name")
+	in.PostId = r.PostForm.Get("post_id")
+	in.Text = r.PostForm.Get("text")
+	in.TriggerWord = r.PostForm.Get("trigger_word")
+	in.Command = r.PostForm.Get("command")
+	return &in, nil
+}
+
+// Handler receives outgoing webhooks and slash commands.
+func (a *Adapter) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", http.StatusBadRequest)
+		log.Warnf("Got a %s request to mattermost handler.", r.Method)
+		return
+	}
+
+	in, err := decodeIncoming(r)
+	if err != nil {
+		http.Error(w, "Invalid post body", http.StatusBadRequest)
+		log.Warn("Could not decode mattermost message: ", err)
+		return
+	}
+
+	if a.WebhookToken != "" && subtle.ConstantTimeCompare([]byte(in.Token), []byte(a.WebhookToken)) != 1 {
+		http.Error(w, "Invalid token", http.StatusForbidden)
+		log.Warnf("Got mattermost message with invalid token from %s", r.RemoteAddr)
+		return
+	}
+
+	log.Debugf("Got mattermost message: %+v", in)
+
+	if a.messages == nil {
+		return
+	}
+
+	// outgoing webhooks include the trigger word in the text
+	text := in.Text
+	if in.TriggerWord != "" {
+		text = strings.TrimPrefix(text, in.TriggerWord)
+	}
+
+	message := chat.Message{
+		Platform:  Platform,
+		TeamId:    in.TeamId,
+		ChannelId: in.ChannelId,
+		Direct:    in.IsDirect(),
+		UserId:    in.UserId,
+		UserName:  in.UserName,
+		Text:      strings.TrimSpace(text),
+		Id:        in.PostId,
+	}
+
+	reply := a.messages(&message)
+	if reply == nil {
+		return
+	}
+
+	// replies that fit in the response go back that way, the rest goes
+	// through the api
+	var res *response
+	switch {
+	case reply.ThreadId != "" || reply.Visibility == chat.Direct:
+	case in.Command != "" && reply.Visibility == chat.Ephemeral:
+		res = &response{Text: reply.Text, ResponseType: "ephemeral"}
+	case in.Command != "":
+		res = &response{Text: reply.Text, ResponseType: "in_channel"}
+	case reply.Visibility == chat.Channel:
+		res = &response{Text: reply.Text}
+	}
+
+	if res == nil {
+		if _, err := a.Send(&message, reply); err != nil {
+			log.Warn("Could not send reply: ", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Warn("Could not send response: ", err)
+	}
+}
+
+type apiError struct {
+	Message string `json:"message"`
+}
+
+// api calls a method of the REST api and decodes the response into result.
+func (a *Adapter) api(method string, path string, body interface{}, result interface{}) error {
+	if a.Token == "" {
+		return chat.ErrUnsupported
+	}
+
+	var payload io.Reader
+	if body != nil {
+		out, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewBuffer(out)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(a.URL, "/")+"/api/v4"+path, payload)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := a.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		reset, _ := strconv.Atoi(resp.Header.Get("X-Ratelimit-Reset"))
+		if reset <= 0 {
+			reset = 1
+		}
+		return &chat.RateLimitError{RetryAfter: time.Duration(reset) * time.Second}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e apiError
+		json.NewDecoder(resp.Body).Decode(&e)
+		return errors.New(fmt.Sprintf("%s %s failed with %d: %s", method, path, resp.StatusCode, e.Message))
+	}
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+type post struct {
+	Id        string `json:"id,omitempty"`
+	ChannelId string `json:"channel_id"`
+	RootId    string `json:"root_id,omitempty"`
+	Message   string `json:"message"`
+}
+
+func (a *Adapter) post(channel string, root string, text string) (string, error) {
+	var created post
+	p := post{ChannelId: channel, RootId: root, Message: text}
+	if err := a.api("POST", "/posts", &p, &created); err != nil {
+		return "", err
+	}
+	return created.Id, nil
+}
+
+func (a *Adapter) postEphemeral(user string, channel string, text string) error {
+	body := struct {
+		UserId string `json:"user_id"`
+		Post   post   `json:"post"`
+	}{user, post{ChannelId: channel, Message: text}}
+	return a.api("POST", "/posts/ephemeral", &body, nil)
+}
+
+func (a *Adapter) me() (string, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.botUserId != "" {
+		return a.botUserId, nil
+	}
+
+	var me struct {
+		Id string `json:"id"`
+	}
+	if err := a.api("GET", "/users/me", nil, &me); err != nil {
+		return "", err
+	}
+	a.botUserId = me.Id
+	return me.Id, nil
+}
+
+func (a *Adapter) directChannel(user string) (string, error) {
+	bot, err := a.me()
+	if err != nil {
+		return "", err
+	}
+
+	var channel struct {
+		Id string `json:"id"`
+	}
+	if err := a.api("POST", "/channels/direct", []string{bot, user}, &channel); err != nil {
+		return "", err
+	}
+	return channel.Id, nil
+}
+
+// Send delivers a reply through the api. Mattermost can't show thread
+// replies in the channel, so broadcasts are posted to the channel instead.
+func (a *Adapter) Send(to *chat.Message, reply *chat.Reply) (string, error) {
+	switch reply.Visibility {
+	case chat.Ephemeral:
+		if to.Direct {
+			return a.post(to.ChannelId, "", reply.Text)
+		}
+		return "", a.postEphemeral(to.UserId, to.ChannelId, reply.Text)
+	case chat.Direct:
+		channel, err := a.directChannel(to.UserId)
+		if err != nil {
+			return "", err
+		}
+		return a.post(channel, "", reply.Text)
+	default:
+		if to.ChannelId == "" {
+			return "", errors.New("No channel to post to")
+		}
+		root := reply.ThreadId
+		if reply.Broadcast {
+			root = ""
+		}
+		return a.post(to.ChannelId, root, reply.Text)
+	}
+}
+
+type user struct {
+	Id        string `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Nickname  string `json:"nickname"`
+	Email     string `json:"email"`
+	Roles     string `json:"roles"`
+	DeleteAt  int64  `json:"delete_at"`
+	Timezone  struct {
+		UseAutomaticTimezone string `json:"useAutomaticTimezone"`
+		AutomaticTimezone    string `json:"automaticTimezone"`
+		ManualTimezone       string `json:"manualTimezone"`
+	} `json:"timezone"`
+}
+
+func (a *Adapter) LookupUser(teamId string, userId string) (*chat.Profile, error) {
+	var u user
+	if err := a.api("GET", "/users/"+userId, nil, &u); err != nil {
+		return nil, err
+	}
+
+	timezone := u.Timezone.ManualTimezone
+	if u.Timezone.UseAutomaticTimezone == "true" {
+		timezone = u.Timezone.AutomaticTimezone
+	}
+
+	return &chat.Profile{
+		Id:          u.Id,
+		Name:        u.Username,
+		DisplayName: u.Nickname,
+		RealName:    strings.TrimSpace(u.FirstName + " " + u.LastName),
+		Avatar:      strings.TrimRight(a.URL, "/") + "/api/v4/users/" + u.Id + "/image",
+		Email:       u.Email,
+		Timezone:    timezone,
+		Deleted:     u.DeleteAt > 0,
+		Admin:       strings.Contains(u.Roles, "system_admin"),
+	}, nil
+}
+
+// MembersPage is how many channel members are fetched at once.
+const MembersPage = 200
+
+// ChannelMembers fetches the members of a channel a page at a time, and
+// their usernames since that's what mentions go by.
+func (a *Adapter) ChannelMembers(teamId string, channelId string) ([]chat.Profile, error) {
+	bot, err := a.me()
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := []chat.Profile{}
+	for page := 0; ; page++ {
+		var members []struct {
+			UserId string `json:"user_id"`
+		}
+		path := fmt.Sprintf("/channels/%s/members?page=%d&per_page=%d", channelId, page, MembersPage)
+		if err := a.api("GET", path, nil, &members); err != nil {
+			return nil, err
+		}
+
+		ids := []string{}
+		for _, m := range members {
+			if m.UserId != bot {
+				ids = append(ids, m.UserId)
+			}
+		}
+		if len(ids) > 0 {
+			var users []user
+			if err := a.api("POST", "/users/ids", ids, &users); err != nil {
+				return nil, err
+			}
+			for _, u := range users {
+				profiles = append(profiles, chat.Profile{Id: u.Id, Name: u.Username, Deleted: u.DeleteAt > 0})
+			}
+		}
+
+		if len(members) < MembersPage {
+			return profiles, nil
+		}
+	}
+}
+
+func (a *Adapter) Mention(userId string, username string) string {
+	if username == "" {
+		// the id doesn't notify anyone but it's better than nothing
+		return "@" + userId
+	}
+	return "@" + username
+}
@@ -0,0 +1,172 @@
+package mattermost
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"ninja/chat"
+	"strings"
+	"testing"
+)
+
+func webhook(a *Adapter, token string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"token":        {token},
+		"team_id":      {"T1"},
+		"channel_id":   {"C1"},
+		"channel_name": {"coffee"},
+		"user_id":      {"U1"},
+		"user_name":    {"bob"},
+		"text":         {"ninja help"},
+		"trigger_word": {"ninja"},
+	}
+	r := httptest.NewRequest("POST", "/mattermost", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	a.Handler(w, r)
+	return w
+}
+
+func TestHandlerToken(t *testing.T) {
+	var got *chat.Message
+	a := &Adapter{WebhookToken: "secret"}
+	a.Receive(func(m *chat.Message) *chat.Reply {
+		got = m
+		return chat.NewReply("hi")
+	}, nil)
+
+	if w := webhook(a, "wrong"); w.Code != http.StatusForbidden {
+		t.Errorf("wrong token got %d", w.Code)
+	}
+	if got != nil {
+		t.Fatal("message with the wrong token was handled")
+	}
+
+	w := webhook(a, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("right token got %d", w.Code)
+	}
+	if got == nil || got.Text != "help" || got.TeamId != "T1" || got.UserId != "U1" {
+		t.Errorf("handled %+v", got)
+	}
+	res := response{}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.Text != "hi" {
+		t.Errorf("responded %q: %v", res.Text, err)
+	}
+}
+
+// fakeServer answers the api calls Send makes and keeps the posts it got.
+func fakeServer(t *testing.T, posts *[]post) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(apiError{Message: "who are you"})
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v4/users/me":
+			json.NewEncoder(w).Encode(map[string]string{"id": "BOT"})
+		case "POST /api/v4/channels/direct":
+			ids := []string{}
+			json.NewDecoder(r.Body).Decode(&ids)
+			json.NewEncoder(w).Encode(map[string]string{"id": "D_" + strings.Join(ids, "_")})
+		case "GET /api/v4/channels/C1/members":
+			members := []map[string]string{}
+			if r.URL.Query().Get("page") == "0" {
+				for i := 0; i < MembersPage-2; i++ {
+					members = append(members, map[string]string{"user_id": fmt.Sprintf("U%d", i)})
+				}
+				members = append(members, map[string]string{"user_id": "BOT"}, map[string]string{"user_id": "GONE"})
+			} else {
+				members = append(members, map[string]string{"user_id": "LAST"})
+			}
+			json.NewEncoder(w).Encode(members)
+		case "POST /api/v4/users/ids":
+			ids := []string{}
+			json.NewDecoder(r.Body).Decode(&ids)
+			users := []user{}
+			for _, id := range ids {
+				u := user{Id: id, Username: strings.ToLower(id)}
+				if id == "GONE" {
+					u.DeleteAt = 1
+				}
+				users = append(users, u)
+			}
+			json.NewEncoder(w).Encode(users)
+		case "POST /api/v4/posts":
+			p := post{}
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				t.Error(err)
+			}
+			p.Id = "P1"
+			*posts = append(*posts, p)
+			json.NewEncoder(w).Encode(p)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestSend(t *testing.T) {
+	posts := []post{}
+	server := fakeServer(t, &posts)
+	defer server.Close()
+	a := &Adapter{URL: server.URL + "/", Token: "token"}
+	to := &chat.Message{Platform: Platform, TeamId: "T1", ChannelId: "C1", UserId: "U1"}
+
+	id, err := a.Send(to, &chat.Reply{Text: "in the thread", ThreadId: "R1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "P1" {
+		t.Errorf("Send returned %q", id)
+	}
+	if _, err := a.Send(to, chat.DirectReply("just for you")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []post{
+		{Id: "P1", ChannelId: "C1", RootId: "R1", Message: "in the thread"},
+		{Id: "P1", ChannelId: "D_BOT_U1", Message: "just for you"},
+	}
+	if len(posts) != len(want) {
+		t.Fatalf("posted %+v", posts)
+	}
+	for i := range want {
+		if posts[i] != want[i] {
+			t.Errorf("post %d is %+v instead of %+v", i, posts[i], want[i])
+		}
+	}
+
+	a.Token = "wrong"
+	if _, err := a.Send(to, chat.NewReply("nope")); err == nil || !strings.Contains(err.Error(), "who are you") {
+		t.Errorf("Send with the wrong token: %v", err)
+	}
+}
+
+func TestChannelMembers(t *testing.T) {
+	server := fakeServer(t, &[]post{})
+	defer server.Close()
+	a := &Adapter{URL: server.URL, Token: "token"}
+
+	members, err := a.ChannelMembers("T1", "C1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a full page, less the bot, then the one on the next page
+	if len(members) != MembersPage {
+		t.Fatalf("got %d members", len(members))
+	}
+	if m := members[0]; m.Id != "U0" || m.Name != "u0" || m.Deleted {
+		t.Errorf("first member is %+v", m)
+	}
+	if m := members[len(members)-2]; m.Id != "GONE" || !m.Deleted {
+		t.Errorf("deleted member is %+v", m)
+	}
+	if m := members[len(members)-1]; m.Id != "LAST" || m.Name != "last" {
+		t.Errorf("last member is %+v", m)
+	}
+}
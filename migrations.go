@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"ninja/phone"
+	"os"
+	"time"
+)
+
+// Migration takes the mongo database from one version to the next. They
+// run in order and only once, add new ones at the end and never change one
+// that has been released.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(s *MongoStore) error
+}
+
+// AppliedMigration is what's kept in the migrations collection.
+type AppliedMigration struct {
+	Version int       `bson:"_id"`
+	Name    string    `bson:"name"`
+	Started time.Time `bson:"started"`
+	Applied time.Time `bson:"applied"`
+}
+
+var Migrations = []Migration{
+	{1, "records from before platforms are on slack", migratePlatforms},
+	{2, "one user per team and user id", migrateUniqueUsers},
+	{3, "one user per phone number", migrateUniquePhones},
+	{4, "index runs by team and start", migrateRunIndexes},
+	{5, "index seen, outbox, deliveries and audit", migrateIndexes},
+	{6, "no verification codes in deliveries", migrateCodeDeliveries},
+	{7, "expire sent and dead outbox messages", migrateOutboxExpiry},
+	{8, "mask phone numbers in the audit trail", migrateMaskAudit},
+}
+
+func ensureIndexes(s *MongoStore, collection string, indexes ...mgo.Index) error {
+	for _, index := range indexes {
+		if err := s.C(collection).EnsureIndex(index); err != nil {
+			return errors.New(fmt.Sprintf("Could not index %s by %v: %s", collection, index.Key, err))
+		}
+	}
+	return nil
+}
+
+func migratePlatforms(s *MongoStore) error {
+	legacy := bson.M{"platform": bson.M{"$exists": false}}
+	for _, name := range []string{"users", "runs"} {
+		if _, err := s.C(name).UpdateAll(legacy, bson.M{"$set": bson.M{"platform": DefaultPlatform}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateUniqueUsers merges users that were created twice by messages
+// arriving at the same time, the verified or oldest one is kept.
+func migrateUniqueUsers(s *MongoStore) error {
+	var users []User
+	if err := s.C("users").Find(nil).Sort("_id").All(&users); err != nil {
+		return err
+	}
+
+	keep := map[string]*User{}
+	for i := range users {
+		user := &users[i]
+		key := user.TeamId + "/" + user.UserId
+		kept, ok := keep[key]
+		if !ok {
+			keep[key] = user
+			continue
+		}
+
+		if user.PhoneValid && !kept.PhoneValid {
+			user, kept = kept, user
+			keep[key] = kept
+		}
+		log.Infof("Merging duplicate user %s into %s", user.Id.Hex(), kept.Id.Hex())
+		if err := mergeUser(s, user.Id, kept.Id); err != nil {
+			return err
+		}
+	}
+
+	return ensureIndexes(s, "users", mgo.Index{Key: []string{"team_id", "user_id"}, Unique: true})
+}
+
+// mergeUser moves the runs and orders of user from to user to and removes
+// from.
+func mergeUser(s *MongoStore, from bson.ObjectId, to bson.ObjectId) error {
+	if _, err := s.C("runs").UpdateAll(bson.M{"runner": from}, bson.M{"$set": bson.M{"runner": to}}); err != nil {
+		return err
+	}
+
+	var runs []Run
+	if err := s.C("runs").Find(bson.M{"items.owner_id": from}).All(&runs); err != nil {
+		return err
+	}
+	for _, run := range runs {
+		for i := range run.Items {
+			if run.Items[i].OwnerId == from {
+				run.Items[i].OwnerId = to
+			}
+		}
+		if err := s.C("runs").UpdateId(run.Id, bson.M{"$set": bson.M{"items": run.Items}}); err != nil {
+			return err
+		}
+	}
+
+	return s.C("users").RemoveId(from)
+}
+
+// phoneOwner is as much of a user as it takes to tell who keeps a number.
+type phoneOwner struct {
+	Id         bson.ObjectId `bson:"_id"`
+	Phone      string        `bson:"phone"`
+	PhoneValid bool          `bson:"phone_valid"`
+}
+
+// phoneDuplicates picks the users that lose their number because someone
+// else has it too, the one who verified it or the newest one keeps it.
+// owners are oldest first.
+func phoneDuplicates(owners []phoneOwner) []bson.ObjectId {
+	keep := map[string]*phoneOwner{}
+	lose := []bson.ObjectId{}
+	for i := range owners {
+		owner := &owners[i]
+		kept, ok := keep[owner.Phone]
+		if !ok {
+			keep[owner.Phone] = owner
+			continue
+		}
+		if kept.PhoneValid && !owner.PhoneValid {
+			lose = append(lose, owner.Id)
+			continue
+		}
+		lose = append(lose, kept.Id)
+		keep[owner.Phone] = owner
+	}
+	return lose
+}
+
+func migrateUniquePhones(s *MongoStore) error {
+	// users from before phone was omitted when empty would clash
+	if _, err := s.C("users").UpdateAll(bson.M{"phone": ""}, bson.M{"$unset": bson.M{"phone": ""}}); err != nil {
+		return err
+	}
+
+	// and so would people who registered the same number, which used to work
+	var owners []phoneOwner
+	if err := s.C("users").Find(bson.M{"phone": bson.M{"$exists": true}}).Sort("_id").All(&owners); err != nil {
+		return err
+	}
+	for _, id := range phoneDuplicates(owners) {
+		log.Infof("Removing the number of %s, someone else has it too", id.Hex())
+		unset := bson.M{"$unset": bson.M{"phone": "", "phone_enc": ""}, "$set": bson.M{"phone_valid": false}}
+		if err := s.C("users").UpdateId(id, unset); err != nil {
+			return err
+		}
+	}
+
+	return ensureIndexes(s, "users", mgo.Index{Key: []string{"phone"}, Unique: true, Sparse: true})
+}
+
+func migrateRunIndexes(s *MongoStore) error {
+	return ensureIndexes(s, "runs",
+		mgo.Index{Key: []string{"team_id", "active"}},
+		mgo.Index{Key: []string{"started"}},
+	)
+}
+
+func migrateIndexes(s *MongoStore) error {
+	if err := ensureIndexes(s, "seen", mgo.Index{Key: []string{"created"}, ExpireAfter: SeenTTL}); err != nil {
+		return err
+	}
+	if err := ensureIndexes(s, "outbox", mgo.Index{Key: []string{"status", "next_attempt"}}); err != nil {
+		return err
+	}
+	if err := ensureIndexes(s, "deliveries", mgo.Index{Key: []string{"to", "kind", "-created"}}); err != nil {
+		return err
+	}
+	return ensureIndexes(s, "audit", mgo.Index{Key: []string{"user", "time"}})
+}
+
+func migrateCodeDeliveries(s *MongoStore) error {
+	_, err := s.C("deliveries").UpdateAll(
+		bson.M{"kind": DeliveryCode},
+		bson.M{"$set": bson.M{"text": CodeDeliveryText}},
+	)
+	return err
+}
+
+func migrateOutboxExpiry(s *MongoStore) error {
+	sent := s.C("outbox").Find(bson.M{"status": OutboxSent, "done": bson.M{"$exists": false}}).Iter()
+	msg := OutboxMessage{}
+	for sent.Next(&msg) {
+		if err := s.C("outbox").UpdateId(msg.Id, bson.M{"$set": bson.M{"done": msg.Sent}}); err != nil {
+			sent.Close()
+			return err
+		}
+	}
+	if err := sent.Close(); err != nil {
+		return err
+	}
+
+	// there's no telling when dead ones died, they get another OutboxKeep
+	dead := bson.M{"status": OutboxDead, "done": bson.M{"$exists": false}}
+	if _, err := s.C("outbox").UpdateAll(dead, bson.M{"$set": bson.M{"done": time.Now()}}); err != nil {
+		return err
+	}
+	return ensureIndexes(s, "outbox", mgo.Index{Key: []string{"done"}, ExpireAfter: OutboxKeep})
+}
+
+// migrateMaskAudit masks the numbers audit entries had before they were
+// masked, masking them again changes nothing.
+func migrateMaskAudit(s *MongoStore) error {
+	entries := s.C("audit").Find(bson.M{"action": bson.M{"$in": PhoneActions}}).Iter()
+	entry := AuditEntry{}
+	for entries.Next(&entry) {
+		masked := phone.Mask(entry.Detail)
+		if masked == entry.Detail {
+			continue
+		}
+		if err := s.C("audit").UpdateId(entry.Id, bson.M{"$set": bson.M{"detail": masked}}); err != nil {
+			entries.Close()
+			return err
+		}
+	}
+	return entries.Close()
+}
+
+// AppliedMigrations are the migrations that have run, or started running,
+// by version.
+func (s *MongoStore) AppliedMigrations() (map[int]AppliedMigration, error) {
+	var applied []AppliedMigration
+	if err := s.C("migrations").Find(nil).All(&applied); err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]AppliedMigration)
+	for _, m := range applied {
+		byVersion[m.Version] = m
+	}
+	return byVersion, nil
+}
+
+// Migrate runs the migrations that haven't run yet. Each one is claimed in
+// the migrations collection first so two instances starting at once don't
+// both run it.
+func (s *MongoStore) Migrate() error {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range Migrations {
+		if done, ok := applied[m.Version]; ok {
+			if done.Applied.IsZero() {
+				return errors.New(fmt.Sprintf(
+					"Migration %d (%s) is running or was interrupted, remove it from migrations to run it again",
+					m.Version, m.Name,
+				))
+			}
+			continue
+		}
+
+		record := AppliedMigration{Version: m.Version, Name: m.Name, Started: time.Now()}
+		if err := s.C("migrations").Insert(&record); mgo.IsDup(err) {
+			return errors.New(fmt.Sprintf("Migration %d (%s) was started by someone else", m.Version, m.Name))
+		} else if err != nil {
+			return err
+		}
+
+		log.Infof("Migrating to %d: %s", m.Version, m.Name)
+		if err := m.Up(s); err != nil {
+			s.C("migrations").RemoveId(m.Version)
+			return errors.New(fmt.Sprintf("Migration %d (%s) failed: %s", m.Version, m.Name, err))
+		}
+
+		if err := s.C("migrations").UpdateId(m.Version, bson.M{"$set": bson.M{"applied": time.Now()}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunMigrate is `ninja migrate up|status`.
+func RunMigrate(args []string) {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "status") {
+		fmt.Fprintln(os.Stderr, "usage: ninja migrate up|status")
+		os.Exit(2)
+	}
+
+	store, err := OpenStore(StoreURL())
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, ok := store.(*MongoStore)
+	if !ok {
+		log.Fatal("Only mongo has migrations, other stores are always up to date")
+	}
+
+	if args[0] == "up" {
+		if err := s.Migrate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range Migrations {
+		status := "pending"
+		if done, ok := applied[m.Version]; ok && done.Applied.IsZero() {
+			status = "started " + done.Started.Format(time.RFC3339)
+		} else if ok {
+			status = "applied " + done.Applied.Format(time.RFC3339)
+		}
+		fmt.Printf("%3d  %-28s  %s\n", m.Version, status, m.Name)
+	}
+}
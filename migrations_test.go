@@ -0,0 +1,85 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"os"
+	"testing"
+)
+
+func TestPhoneDuplicates(t *testing.T) {
+	ids := make([]bson.ObjectId, 6)
+	for i := range ids {
+		ids[i] = bson.NewObjectId()
+	}
+	owners := []phoneOwner{
+		{ids[0], "+46701234567", true},
+		{ids[1], "+46701234567", false},
+		{ids[2], "+46709876543", false},
+		{ids[3], "+46709876543", false},
+		{ids[4], "+46709876543", false},
+		{ids[5], "+46700000000", false},
+	}
+
+	lose := phoneDuplicates(owners)
+	want := map[bson.ObjectId]bool{ids[1]: true, ids[2]: true, ids[3]: true}
+	if len(lose) != len(want) {
+		t.Fatalf("took the number from %v", lose)
+	}
+	for _, id := range lose {
+		if !want[id] {
+			t.Errorf("took the number from %s", id.Hex())
+		}
+	}
+}
+
+// TestMigrate needs a mongo to throw away like TestMongoStore, it runs the
+// migrations over users from before numbers were unique.
+func TestMigrate(t *testing.T) {
+	url := os.Getenv("NINJA_TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("NINJA_TEST_MONGO_URL isn't set")
+	}
+	session, err := mgo.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("ninja_test")
+	if err := db.DropDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DropDatabase()
+
+	verified, again, other := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+	for _, user := range []bson.M{
+		{"_id": verified, "team_id": "T1", "user_id": "U1", "phone": "+46701234567", "phone_valid": true},
+		{"_id": again, "team_id": "T1", "user_id": "U2", "phone": "+46701234567", "phone_valid": true},
+		{"_id": other, "team_id": "T1", "user_id": "U3", "phone": ""},
+	} {
+		if err := db.C("users").Insert(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &MongoStore{DB: "ninja_test", session: session}
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) {
+		t.Errorf("%d of %d migrations ran", len(applied), len(Migrations))
+	}
+
+	kept := bson.M{}
+	if err := db.C("users").FindId(again).One(&kept); err != nil || kept["phone"] != "+46701234567" {
+		t.Errorf("the newest verified user was left with %v: %v", kept, err)
+	}
+	lost := bson.M{}
+	if err := db.C("users").FindId(verified).One(&lost); err != nil || lost["phone"] != nil || lost["phone_valid"] != false {
+		t.Errorf("the older user was left with %v: %v", lost, err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"ninja/chat"
+	"ninja/notify"
+	"strings"
+)
+
+// DefaultNotify is the order we try to reach people in unless they've told
+// us otherwise.
+var DefaultNotify = []string{notify.SMS, notify.DM, notify.Email}
+
+// Recipient is how user can be reached outside of the channel, only
+// verified numbers are used.
+func Recipient(user *User) *notify.Recipient {
+	r := notify.Recipient{
+		Name:  user.Name,
+		Email: user.Email,
+		Chat:  &chat.Message{Platform: user.Platform, TeamId: user.TeamId, UserId: user.UserId},
+	}
+	if user.PhoneValid {
+		r.Phone = user.Phone
+		r.NoSMS = user.SMSStopped
+	}
+	return &r
+}
+
+// SetupNotifier sets up the providers, texts and calls go through phone.
+func SetupNotifier(phone notify.Phone) {
+	Env.Phone = phone
+
+	providers := map[string]notify.Provider{
+		notify.SMS:   &notify.SMSProvider{Phone: phone},
+		notify.Voice: &notify.VoiceProvider{Phone: phone, SayURL: Env.Vars.AppURL + "/say"},
+		notify.DM:    &notify.DMProvider{Send: Send},
+	}
+
+	if Env.Vars.SMTPAddr != "" {
+		email := &notify.EmailProvider{Addr: Env.Vars.SMTPAddr, From: Env.Vars.SMTPFrom}
+		if Env.Vars.SMTPUser != "" {
+			host := strings.Split(Env.Vars.SMTPAddr, ":")[0]
+			email.Auth = smtp.PlainAuth("", Env.Vars.SMTPUser, Env.Vars.SMTPPassword, host)
+		}
+		providers[notify.Email] = email
+	}
+
+	Env.Notifier = &notify.Notifier{Providers: providers, Default: DefaultNotify}
+}
+
+func NotifyListCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	order := user.Notify
+	if len(order) == 0 {
+		order = DefaultNotify
+	}
+	return chat.EphemeralReply(fmt.Sprintf(
+		"When I need to reach you I'll try %s. Change it with `notify <sms|voice|email|dm> ...`",
+		strings.Join(order, ", then "),
+	))
+}
+
+func NotifyCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	order := strings.Fields(strings.ToLower(args["order"]))
+	for _, name := range order {
+		if !Env.Notifier.Known(name) {
+			return chat.EphemeralReply(fmt.Sprintf("I can't reach anyone by `%s`.", name))
+		}
+	}
+
+	if err := Env.Store.UpdateUser(user.Id, Fields{"notify": order}); err != nil {
+		return ErrorReply(err)
+	}
+
+	return chat.EphemeralReply(fmt.Sprintf("Ok, I'll try %s.", strings.Join(order, ", then ")))
+}
+
+func EmailCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	// slack sends typed addresses as <mailto:a@b.c|a@b.c>
+	email := strings.Trim(args["email"], "<>")
+	email = strings.TrimPrefix(strings.SplitN(email, "|", 2)[0], "mailto:")
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return chat.DirectReply("That doesn't look like an email address to me.")
+	}
+
+	if err := Env.Store.UpdateUser(user.Id, Fields{"email": address.Address}); err != nil {
+		return ErrorReply(err)
+	}
+
+	return chat.DirectReply(fmt.Sprintf("Got it, %s.", address.Address))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"ninja/chat"
+	"testing"
+)
+
+func TestEmailCommand(t *testing.T) {
+	store := Env.Store
+	Env.Store = NewMemoryStore()
+	defer func() { Env.Store = store }()
+
+	user := &User{Id: bson.NewObjectId(), Platform: "slack", TeamId: "T1", UserId: "U1"}
+	if err := Env.Store.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typed := range []string{"bob@example.org", "<bob@example.org>", "<mailto:bob@example.org|bob@example.org>"} {
+		Env.Store.UpdateUser(user.Id, Fields{"email": ""})
+		EmailCommand(ArgMap{"email": typed}, user, &chat.Message{})
+		saved, err := Env.Store.User(user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Email != "bob@example.org" {
+			t.Errorf("%s was saved as %q", typed, saved.Email)
+		}
+	}
+
+	reply := EmailCommand(ArgMap{"email": "<mailto:nope|nope>"}, user, &chat.Message{})
+	if reply == nil || reply.Text != "That doesn't look like an email address to me." {
+		t.Errorf("replied %+v to something that isn't an address", reply)
+	}
+}
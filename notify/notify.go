@@ -0,0 +1,103 @@
+// Package notify gets messages to people outside of the channel they're
+// talking to the bot in. Each way of reaching someone is a Provider, the
+// Notifier tries them in order until one of them gets through.
+package notify
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"ninja/chat"
+	"strings"
+)
+
+// Provider names, these are what users put in their preferences.
+const (
+	SMS   = "sms"
+	Voice = "voice"
+	Email = "email"
+	DM    = "dm"
+)
+
+// ErrUnreachable is returned by providers when the recipient has no
+// address for them, e.g. no phone number.
+var ErrUnreachable = errors.New("No address to send to")
+
+// Recipient is someone to notify and every way we know of reaching them.
+type Recipient struct {
+	Name  string
+	Phone string
+	// NoSMS is set when the number has opted out of texts.
+	NoSMS bool
+	Email string
+	// Chat addresses direct messages on the user's chat platform.
+	Chat *chat.Message
+}
+
+type Notification struct {
+	// From is the number texts and calls come from.
+	From    string
+	Subject string
+	Text    string
+	// CallURL is TwiML to play instead of reading out Text, if any.
+	CallURL string
+}
+
+// Provider sends notifications one way, it returns the id of what it sent
+// if there is one.
+type Provider interface {
+	Notify(r *Recipient, n *Notification) (string, error)
+}
+
+type Notifier struct {
+	Providers map[string]Provider
+	// Default is the order providers are tried in for people who haven't
+	// picked one.
+	Default []string
+}
+
+// Known reports whether there's a provider called name.
+func (n *Notifier) Known(name string) bool {
+	_, ok := n.Providers[name]
+	return ok
+}
+
+// Send notifies r through one provider only.
+func (n *Notifier) Send(provider string, r *Recipient, note *Notification) (string, error) {
+	p, ok := n.Providers[provider]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Unknown provider %s", provider))
+	}
+	return p.Notify(r, note)
+}
+
+// Notify tries the providers in order, falling back to the default order
+// after that. It returns the name of the one that got through and the id of
+// what it sent.
+func (n *Notifier) Notify(r *Recipient, order []string, note *Notification) (string, string, error) {
+	tried := make(map[string]bool)
+	failed := []string{}
+
+	names := append(append([]string{}, order...), n.Default...)
+	for _, name := range names {
+		p, ok := n.Providers[name]
+		if !ok || tried[name] {
+			continue
+		}
+		tried[name] = true
+
+		id, err := p.Notify(r, note)
+		if err == nil {
+			return name, id, nil
+		}
+		if err != ErrUnreachable {
+			log.Warnf("Could not notify %s by %s: %s", r.Name, name, err)
+			failed = append(failed, name)
+		}
+	}
+
+	if len(failed) == 0 {
+		return "", "", errors.New(fmt.Sprintf("I don't know how to reach %s", r.Name))
+	}
+	return "", "", errors.New(fmt.Sprintf("Could not reach %s by %s", r.Name, strings.Join(failed, " or ")))
+}
@@ -0,0 +1,108 @@
+package notify
+
+import (
+	"errors"
+	"ninja/chat"
+	"strings"
+	"testing"
+)
+
+// notifier has a recorder for every provider, sms, voice and dm by default.
+func notifier() (*Notifier, map[string]*Recorder) {
+	recorders := map[string]*Recorder{SMS: {}, Voice: {}, Email: {}, DM: {}}
+	n := &Notifier{Providers: map[string]Provider{}, Default: []string{SMS, Voice, DM}}
+	for name, r := range recorders {
+		n.Providers[name] = r
+	}
+	return n, recorders
+}
+
+var bob = &Recipient{Name: "bob", Phone: "+46701234567", Email: "bob@example.org", Chat: &chat.Message{UserId: "U1"}}
+
+func TestNotifyFallsBack(t *testing.T) {
+	n, recorders := notifier()
+	recorders[SMS].Err = errors.New("twilio is down")
+	recorders[Voice].Err = errors.New("twilio is still down")
+
+	name, id, err := n.Notify(bob, nil, &Notification{Text: "coffee's here"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != DM || id != "1" {
+		t.Errorf("got through by %s with %q", name, id)
+	}
+	sent := recorders[DM].Sent
+	if len(sent) != 1 || sent[0].Recipient.Name != "bob" || sent[0].Notification.Text != "coffee's here" {
+		t.Errorf("dm sent %+v", sent)
+	}
+}
+
+func TestNotifyOrder(t *testing.T) {
+	n, recorders := notifier()
+
+	// what they picked goes first, unknown and repeated names are skipped
+	name, _, err := n.Notify(bob, []string{"pigeon", Email, Email, SMS}, &Notification{Text: "hi"})
+	if err != nil || name != Email {
+		t.Errorf("got through by %s: %v", name, err)
+	}
+	if len(recorders[SMS].Sent) != 0 {
+		t.Error("texted after the email got through")
+	}
+
+	// and the default order after that
+	recorders[Email].Err = errors.New("smtp is down")
+	name, _, err = n.Notify(bob, []string{Email}, &Notification{Text: "hi"})
+	if err != nil || name != SMS {
+		t.Errorf("got through by %s: %v", name, err)
+	}
+	if len(recorders[Email].Sent) != 1 || len(recorders[SMS].Sent) != 1 || len(recorders[Voice].Sent) != 0 {
+		t.Errorf("sent %d emails, %d texts and %d calls", len(recorders[Email].Sent), len(recorders[SMS].Sent), len(recorders[Voice].Sent))
+	}
+}
+
+func TestNotifyUnreachable(t *testing.T) {
+	dms := []string{}
+	dm := &DMProvider{Send: func(to *chat.Message, reply *chat.Reply) (string, error) {
+		dms = append(dms, to.UserId)
+		return "", nil
+	}}
+	n := &Notifier{
+		Providers: map[string]Provider{SMS: &SMSProvider{}, Voice: &VoiceProvider{}, DM: dm},
+		Default:   []string{SMS, Voice, DM},
+	}
+
+	// without a number it's straight to a dm, that's not a failure
+	name, _, err := n.Notify(&Recipient{Name: "alice", Chat: &chat.Message{UserId: "U2"}}, nil, &Notification{Text: "hi"})
+	if err != nil || name != DM || len(dms) != 1 {
+		t.Errorf("got through by %s: %v", name, err)
+	}
+
+	_, _, err = n.Notify(&Recipient{Name: "alice"}, nil, &Notification{Text: "hi"})
+	if err == nil || !strings.Contains(err.Error(), "don't know how to reach alice") {
+		t.Errorf("nowhere to send got %v", err)
+	}
+}
+
+func TestNotifyFails(t *testing.T) {
+	n, recorders := notifier()
+	for _, r := range recorders {
+		r.Err = errors.New("down")
+	}
+	_, _, err := n.Notify(bob, nil, &Notification{Text: "hi"})
+	if err == nil || err.Error() != "Could not reach bob by sms or voice or dm" {
+		t.Errorf("Notify with everything down: %v", err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	n, recorders := notifier()
+	if _, err := n.Send(Voice, bob, &Notification{Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorders[Voice].Sent) != 1 || len(recorders[SMS].Sent) != 0 {
+		t.Error("Send didn't use just the provider it was asked to")
+	}
+	if _, err := n.Send("pigeon", bob, &Notification{Text: "hi"}); err == nil {
+		t.Error("Send by an unknown provider worked")
+	}
+}
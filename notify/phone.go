@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"bitbucket.org/ckvist/twilio/twirest"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"net/url"
+)
+
+// Phone sends texts and places calls, it returns the id of the message or
+// call.
+type Phone interface {
+	Text(from string, to string, body string) (string, error)
+	// Call calls to and plays the TwiML found at url.
+	Call(from string, to string, url string) (string, error)
+}
+
+type Twilio struct {
+	Client *twirest.TwilioClient
+	// StatusCallback is where twilio tells us what happened to texts.
+	StatusCallback string
+}
+
+func (t *Twilio) Text(from string, to string, body string) (string, error) {
+	msg := twirest.SendMessage{Text: body, To: to, From: from, StatusCallback: t.StatusCallback}
+	resp, err := t.Client.Request(msg)
+	if err != nil {
+		return "", err
+	}
+	if resp.Message == nil {
+		return "", errors.New("No message in response from twilio")
+	}
+	log.Debugf("Response from twilio: %s", resp.Message.Status)
+	return resp.Message.Sid, nil
+}
+
+func (t *Twilio) Call(from string, to string, url string) (string, error) {
+	resp, err := t.Client.Request(twirest.MakeCall{Url: url, To: to, From: from})
+	if err != nil {
+		return "", err
+	}
+	if resp.Call == nil {
+		return "", errors.New("No call in response from twilio")
+	}
+	return resp.Call.Sid, nil
+}
+
+// Printer prints texts and calls instead of sending them.
+type Printer struct {
+	Out io.Writer
+}
+
+func (p *Printer) Text(from string, to string, body string) (string, error) {
+	fmt.Fprintf(p.Out, "(text to %s) %s\n", to, body)
+	return "", nil
+}
+
+func (p *Printer) Call(from string, to string, url string) (string, error) {
+	fmt.Fprintf(p.Out, "(calling %s with %s)\n", to, url)
+	return "", nil
+}
+
+// SMSProvider texts the notification.
+type SMSProvider struct {
+	Phone Phone
+}
+
+func (p *SMSProvider) Notify(r *Recipient, n *Notification) (string, error) {
+	if r.Phone == "" || r.NoSMS {
+		return "", ErrUnreachable
+	}
+	return p.Phone.Text(n.From, r.Phone, n.Text)
+}
+
+// VoiceProvider calls and reads out the notification, or plays its CallURL.
+// SayURL is an endpoint that reads out its text parameter, see Say.
+type VoiceProvider struct {
+	Phone  Phone
+	SayURL string
+}
+
+func (p *VoiceProvider) Notify(r *Recipient, n *Notification) (string, error) {
+	if r.Phone == "" {
+		return "", ErrUnreachable
+	}
+	if n.CallURL != "" {
+		return p.Phone.Call(n.From, r.Phone, n.CallURL)
+	}
+	return p.Phone.Call(n.From, r.Phone, p.SayURL+"?"+url.Values{"text": {n.Text}}.Encode())
+}
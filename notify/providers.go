@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"ninja/chat"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EmailProvider sends the notification through an SMTP server.
+type EmailProvider struct {
+	// Addr is the host:port of the server.
+	Addr string
+	Auth smtp.Auth
+	From string
+	// SendMail defaults to smtp.SendMail.
+	SendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func (p *EmailProvider) Notify(r *Recipient, n *Notification) (string, error) {
+	if r.Email == "" {
+		return "", ErrUnreachable
+	}
+
+	subject := n.Subject
+	if subject == "" {
+		subject = "Message from Ninja"
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", p.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", r.Email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(n.Text, "\n", "\r\n", -1))
+
+	send := p.SendMail
+	if send == nil {
+		send = smtp.SendMail
+	}
+	return "", send(p.Addr, p.Auth, p.From, []string{r.Email}, msg.Bytes())
+}
+
+// DMProvider sends the notification as a direct message on the user's chat
+// platform.
+type DMProvider struct {
+	Send func(to *chat.Message, reply *chat.Reply) (string, error)
+}
+
+func (p *DMProvider) Notify(r *Recipient, n *Notification) (string, error) {
+	if r.Chat == nil || r.Chat.UserId == "" {
+		return "", ErrUnreachable
+	}
+	return p.Send(r.Chat, chat.DirectReply(n.Text))
+}
+
+// Recorder remembers notifications instead of sending them, set Err to
+// make it fail.
+type Recorder struct {
+	sync.Mutex
+	Err  error
+	Sent []Recorded
+}
+
+type Recorded struct {
+	Recipient    Recipient
+	Notification Notification
+}
+
+func (p *Recorder) Notify(r *Recipient, n *Notification) (string, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.Err != nil {
+		return "", p.Err
+	}
+	p.Sent = append(p.Sent, Recorded{*r, *n})
+	return strconv.Itoa(len(p.Sent)), nil
+}
+
+// Say serves TwiML reading out the text parameter, it's what the voice
+// provider points calls at.
+func Say(w http.ResponseWriter, r *http.Request) {
+	var text bytes.Buffer
+	xml.EscapeText(&text, []byte(r.FormValue("text")))
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, "%s<Response><Say>%s</Say></Response>\n", xml.Header, text.String())
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	metrics "github.com/yvasiyarov/go-metrics"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"ninja/chat"
+	"sync"
+	"time"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+const (
+	// OutboxMaxAttempts is how many times we try to deliver a message before
+	// giving up on it and leaving it in the outbox as dead.
+	OutboxMaxAttempts = 8
+	// OutboxBackoff is the delay before the first retry, it doubles with
+	// every attempt up to OutboxMaxBackoff.
+	OutboxBackoff    = 2 * time.Second
+	OutboxMaxBackoff = 5 * time.Minute
+	// OutboxKeep is how long sent and dead messages stay in the outbox, long
+	// enough to see what went wrong.
+	OutboxKeep = 7 * 24 * time.Hour
+	// OutboxClaimTimeout is how long a message can be claimed by a worker
+	// before we assume the worker died and hand it to someone else.
+	OutboxClaimTimeout = 2 * time.Minute
+	// OutboxPoll is how often idle workers look for new messages.
+	OutboxPoll = 5 * time.Second
+	// ChannelRate is how fast slack lets us post to one channel.
+	ChannelRate = time.Second
+)
+
+// OutboxMessage is a message waiting to be delivered. Slack messages
+// without a channel go through the incoming webhook.
+type OutboxMessage struct {
+	Id          bson.ObjectId `bson:"_id,omitempty"`
+	Platform    string        `bson:"platform"`
+	TeamId      string        `bson:"team_id"`
+	Channel     string        `bson:"channel"`
+	User        string        `bson:"user"`
+	Message     chat.Reply    `bson:"message"`
+	Status      string        `bson:"status"`
+	Attempts    int           `bson:"attempts"`
+	LastError   string        `bson:"last_error"`
+	Created     time.Time     `bson:"created"`
+	NextAttempt time.Time     `bson:"next_attempt"`
+	Claimed     time.Time     `bson:"claimed"`
+	Sent        time.Time     `bson:"sent"`
+	// Done is when the message was sent or given up on, it's pruned
+	// OutboxKeep after that.
+	Done time.Time `bson:"done,omitempty"`
+}
+
+var OutboxMetrics = struct {
+	Enqueued metrics.Counter
+	Sent     metrics.Counter
+	Retried  metrics.Counter
+	Dead     metrics.Counter
+	Latency  metrics.Timer
+}{
+	metrics.NewRegisteredCounter("outbox.enqueued", metrics.DefaultRegistry),
+	metrics.NewRegisteredCounter("outbox.sent", metrics.DefaultRegistry),
+	metrics.NewRegisteredCounter("outbox.retried", metrics.DefaultRegistry),
+	metrics.NewRegisteredCounter("outbox.dead", metrics.DefaultRegistry),
+	metrics.NewRegisteredTimer("outbox.latency", metrics.DefaultRegistry),
+}
+
+var outboxWake = make(chan bool, 1)
+
+// Enqueue queues a message for delivery to the channel of to. Direct and
+// ephemeral messages also need the user.
+func Enqueue(to *chat.Message, m *chat.Reply) error {
+	now := time.Now()
+	msg := OutboxMessage{
+		Platform:    to.Platform,
+		TeamId:      to.TeamId,
+		Channel:     to.ChannelId,
+		User:        to.UserId,
+		Message:     *m,
+		Status:      OutboxPending,
+		Created:     now,
+		NextAttempt: now,
+	}
+
+	if err := Env.Store.Enqueue(&msg); err != nil {
+		return err
+	}
+
+	OutboxMetrics.Enqueued.Inc(1)
+
+	select {
+	case outboxWake <- true:
+	default:
+	}
+
+	return nil
+}
+
+// ChannelLimiter spaces out messages to the same channel.
+type ChannelLimiter struct {
+	sync.Mutex
+	Interval time.Duration
+	next     map[string]time.Time
+}
+
+// Wait blocks until it's our turn to post to channel.
+func (l *ChannelLimiter) Wait(channel string) {
+	l.Lock()
+	if l.next == nil {
+		l.next = make(map[string]time.Time)
+	}
+	now := time.Now()
+	slot := l.next[channel]
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next[channel] = slot.Add(l.Interval)
+	l.Unlock()
+
+	time.Sleep(slot.Sub(now))
+}
+
+var outboxLimiter = &ChannelLimiter{Interval: ChannelRate}
+
+func sendOutbox(msg *OutboxMessage) error {
+	to := chat.Message{
+		Platform:  msg.Platform,
+		TeamId:    msg.TeamId,
+		ChannelId: msg.Channel,
+		UserId:    msg.User,
+	}
+	_, err := Send(&to, &msg.Message)
+	return err
+}
+
+func deliverOutbox(msg *OutboxMessage) {
+	key := msg.Platform + "/" + msg.Channel
+	if msg.Message.Visibility == chat.Direct {
+		key = msg.Platform + "/" + msg.User
+	}
+	outboxLimiter.Wait(key)
+
+	err := sendOutbox(msg)
+	if err == nil {
+		OutboxMetrics.Sent.Inc(1)
+		OutboxMetrics.Latency.UpdateSince(msg.Created)
+		now := time.Now()
+		update := Fields{"status": OutboxSent, "sent": now, "done": now}
+		if err := Env.Store.UpdateOutbox(msg.Id, update); err != nil {
+			log.Warn("Could not mark outbox message as sent: ", err)
+		}
+		return
+	}
+
+	msg.Attempts++
+
+	if msg.Attempts >= OutboxMaxAttempts {
+		log.Errorf("Giving up on outbox message %s after %d attempts: %s", msg.Id.Hex(), msg.Attempts, err)
+		OutboxMetrics.Dead.Inc(1)
+		update := Fields{"status": OutboxDead, "attempts": msg.Attempts, "last_error": err.Error(), "done": time.Now()}
+		if err := Env.Store.UpdateOutbox(msg.Id, update); err != nil {
+			log.Warn("Could not mark outbox message as dead: ", err)
+		}
+		return
+	}
+
+	delay := OutboxBackoff << uint(msg.Attempts-1)
+	if delay > OutboxMaxBackoff {
+		delay = OutboxMaxBackoff
+	}
+	if limited, ok := err.(*chat.RateLimitError); ok && limited.RetryAfter > delay {
+		delay = limited.RetryAfter
+	}
+
+	log.Warnf("Could not deliver outbox message %s, retrying in %s: %s", msg.Id.Hex(), delay, err)
+	OutboxMetrics.Retried.Inc(1)
+
+	update := Fields{
+		"status":       OutboxPending,
+		"attempts":     msg.Attempts,
+		"last_error":   err.Error(),
+		"next_attempt": time.Now().Add(delay),
+	}
+	if err := Env.Store.UpdateOutbox(msg.Id, update); err != nil {
+		log.Warn("Could not reschedule outbox message: ", err)
+	}
+}
+
+func OutboxWorker() {
+	for {
+		msg, err := Env.Store.ClaimOutbox(time.Now())
+		if err != nil {
+			if err != ErrNotFound {
+				log.Warn("Could not claim outbox message: ", err)
+			}
+			select {
+			case <-outboxWake:
+			case <-time.After(OutboxPoll):
+			}
+			continue
+		}
+		deliverOutbox(msg)
+	}
+}
+
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metrics.DefaultRegistry); err != nil {
+		log.Warn("Could not encode metrics: ", err)
+	}
+}
+
+func SetupOutbox() {
+	for i := 0; i < Env.Vars.OutboxWorkers; i++ {
+		go OutboxWorker()
+	}
+
+	log.Infof("Started %d outbox workers", Env.Vars.OutboxWorkers)
+}
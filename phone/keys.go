@@ -0,0 +1,135 @@
+package phone
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownKey is returned when a number was sealed with a key that isn't
+// in the keyring.
+var ErrUnknownKey = errors.New("phone: sealed with a key that isn't in the keyring")
+
+// Keyring seals numbers with AES-GCM for storage. Numbers are sealed with the
+// current key and can be opened with any key in the ring, so keys can be
+// rotated by adding a new one in front and sealing everything again.
+//
+// Index is a keyed hash of a number, it's the same every time so it can be
+// looked up and kept unique without opening anything. Its key can't be
+// rotated without reindexing everything.
+type Keyring struct {
+	Current string
+	keys    map[string]cipher.AEAD
+	index   []byte
+}
+
+func decodeKey(key string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 32 {
+		return nil, errors.New(fmt.Sprintf("phone: keys are 32 bytes, got %d", len(raw)))
+	}
+	return raw, nil
+}
+
+// ParseKeyring reads keys in the form "id:base64,id:base64", the first one is
+// the current key, and the base64 key of the index. Keys are 32 random bytes,
+// e.g. from `openssl rand -base64 32`.
+func ParseKeyring(keys string, indexKey string) (*Keyring, error) {
+	k := Keyring{keys: make(map[string]cipher.AEAD)}
+
+	for _, entry := range strings.Split(keys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("phone: keys should look like id:base64,id:base64")
+		}
+		if _, ok := k.keys[parts[0]]; ok {
+			return nil, errors.New(fmt.Sprintf("phone: key %s is there twice", parts[0]))
+		}
+
+		raw, err := decodeKey(parts[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("phone: key %s: %s", parts[0], err))
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		k.keys[parts[0]] = aead
+		if k.Current == "" {
+			k.Current = parts[0]
+		}
+	}
+
+	index, err := decodeKey(indexKey)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("phone: index key: %s", err))
+	}
+	k.index = index
+
+	return &k, nil
+}
+
+// Seal encrypts number with the current key, the result starts with the id
+// of the key.
+func (k *Keyring) Seal(number string) (string, error) {
+	aead := k.keys[k.Current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(number), nil)
+	return k.Current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts something made by Seal, with whichever key it was sealed
+// with.
+func (k *Keyring) Open(sealed string) (string, error) {
+	aead, ok := k.keys[KeyId(sealed)]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(sealed[strings.Index(sealed, ":")+1:])
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < aead.NonceSize() {
+		return "", errors.New("phone: sealed number is too short")
+	}
+	number, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(number), nil
+}
+
+// KeyId is the id of the key sealed was sealed with.
+func KeyId(sealed string) string {
+	i := strings.Index(sealed, ":")
+	if i < 0 {
+		return ""
+	}
+	return sealed[:i]
+}
+
+// Index is the blind index of number, hex so it never looks like a number.
+func (k *Keyring) Index(number string) string {
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(number))
+	return hex.EncodeToString(mac.Sum(nil))
+}
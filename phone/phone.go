@@ -0,0 +1,200 @@
+// Package phone turns the numbers people type into E.164, i.e. a plus, the
+// country calling code and the national number without any trunk prefix.
+package phone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Region is what we know about numbers in a country.
+type Region struct {
+	// CallingCode is the country calling code without the plus.
+	CallingCode string
+	// Trunk is the prefix dialed in front of national numbers in the
+	// country, e.g. the 0 in 04xx xxx xxx, it's not part of the E.164 number.
+	Trunk string
+	// Min and Max are the allowed lengths of the national number.
+	Min int
+	Max int
+}
+
+// Regions by ISO 3166 code.
+var Regions = map[string]Region{
+	"AE": {"971", "0", 8, 9},
+	"AR": {"54", "0", 10, 10},
+	"AT": {"43", "0", 4, 13},
+	"AU": {"61", "0", 9, 9},
+	"BE": {"32", "0", 8, 9},
+	"BR": {"55", "0", 10, 11},
+	"CA": {"1", "1", 10, 10},
+	"CH": {"41", "0", 9, 9},
+	"CN": {"86", "0", 7, 11},
+	"CZ": {"420", "", 9, 9},
+	"DE": {"49", "0", 6, 13},
+	"DK": {"45", "", 8, 8},
+	"EE": {"372", "", 7, 8},
+	"ES": {"34", "", 9, 9},
+	"FI": {"358", "0", 5, 12},
+	"FR": {"33", "0", 9, 9},
+	"GB": {"44", "0", 9, 10},
+	"GR": {"30", "", 10, 10},
+	"HK": {"852", "", 8, 8},
+	"ID": {"62", "0", 8, 12},
+	"IE": {"353", "0", 7, 9},
+	"IL": {"972", "0", 8, 9},
+	"IN": {"91", "0", 10, 10},
+	"IS": {"354", "", 7, 7},
+	"IT": {"39", "", 6, 11},
+	"JP": {"81", "0", 9, 10},
+	"KR": {"82", "0", 8, 11},
+	"MX": {"52", "", 10, 10},
+	"MY": {"60", "0", 8, 10},
+	"NL": {"31", "0", 9, 9},
+	"NO": {"47", "", 8, 8},
+	"NZ": {"64", "0", 8, 10},
+	"PH": {"63", "0", 8, 10},
+	"PL": {"48", "", 9, 9},
+	"PT": {"351", "", 9, 9},
+	"RU": {"7", "8", 10, 10},
+	"SE": {"46", "0", 7, 10},
+	"SG": {"65", "", 8, 8},
+	"TH": {"66", "0", 8, 9},
+	"TR": {"90", "0", 10, 10},
+	"UA": {"380", "0", 9, 9},
+	"US": {"1", "1", 10, 10},
+	"ZA": {"27", "0", 9, 9},
+}
+
+// MinDigits and MaxDigits bound the length of E.164 numbers in countries
+// that aren't in Regions, calling code included.
+const (
+	MinDigits = 8
+	MaxDigits = 15
+)
+
+var ErrNoRegion = errors.New("Number has no country code and there's no region to assume")
+
+// Known reports whether region is in Regions.
+func Known(region string) bool {
+	_, ok := Regions[strings.ToUpper(region)]
+	return ok
+}
+
+// byCallingCode finds the region numbers starting with digits belong to, and
+// how many of the digits are the calling code. Regions that share a code
+// (like the US and Canada) share the rules too.
+func byCallingCode(digits string) (Region, int, bool) {
+	for n := 1; n <= 3 && n <= len(digits); n++ {
+		for _, region := range Regions {
+			if region.CallingCode == digits[:n] {
+				return region, n, true
+			}
+		}
+	}
+	return Region{}, 0, false
+}
+
+// clean drops everything but digits and a leading plus, "00" in front is
+// taken as the international prefix.
+func clean(number string) (string, bool, error) {
+	number = strings.TrimSpace(number)
+	international := strings.HasPrefix(number, "+") || strings.HasPrefix(number, "00")
+	if strings.HasPrefix(number, "+") {
+		number = number[1:]
+	} else if strings.HasPrefix(number, "00") {
+		number = number[2:]
+	}
+
+	// +44 (0)20 ... has the trunk prefix in parentheses, it's not dialed from
+	// abroad
+	if international {
+		number = strings.Replace(number, "(0)", "", 1)
+	}
+
+	digits := ""
+	for _, c := range number {
+		switch {
+		case c >= '0' && c <= '9':
+			digits += string(c)
+		case strings.ContainsRune(" -.()/", c):
+		default:
+			return "", false, errors.New(fmt.Sprintf("Unexpected %q in number", c))
+		}
+	}
+	return digits, international, nil
+}
+
+// Normalize parses number and returns it in E.164. Numbers without a country
+// code are taken to be in region, which can be empty if there's no default.
+func Normalize(number string, region string) (string, error) {
+	digits, international, err := clean(number)
+	if err != nil {
+		return "", err
+	}
+	if digits == "" {
+		return "", errors.New("Number has no digits")
+	}
+
+	var r Region
+	var national string
+	if international {
+		var n int
+		var ok bool
+		if r, n, ok = byCallingCode(digits); !ok {
+			// all we can check is what holds everywhere
+			if len(digits) < MinDigits || len(digits) > MaxDigits {
+				return "", errors.New(fmt.Sprintf("Numbers have %d to %d digits with the country code", MinDigits, MaxDigits))
+			}
+			return "+" + digits, nil
+		}
+		national = digits[n:]
+		// some people keep the trunk prefix after the country code
+		if !r.valid(national) && r.Trunk != "" && strings.HasPrefix(national, r.Trunk) {
+			national = national[len(r.Trunk):]
+		}
+	} else {
+		if region == "" {
+			return "", ErrNoRegion
+		}
+		var ok bool
+		if r, ok = Regions[strings.ToUpper(region)]; !ok {
+			return "", errors.New(fmt.Sprintf("Unknown region %s", region))
+		}
+		national = digits
+		if r.Trunk != "" && strings.HasPrefix(national, r.Trunk) && r.valid(national[len(r.Trunk):]) {
+			national = national[len(r.Trunk):]
+		}
+	}
+
+	if !r.valid(national) {
+		return "", errors.New(fmt.Sprintf("Numbers in +%s have %s digits after the country code", r.CallingCode, r.lengths()))
+	}
+
+	return "+" + r.CallingCode + national, nil
+}
+
+// Mask hides all but the start and the last two digits of number, for logs
+// and audit trails.
+func Mask(number string) string {
+	if len(number) < 8 {
+		return strings.Repeat("*", len(number))
+	}
+	return number[:4] + strings.Repeat("*", len(number)-6) + number[len(number)-2:]
+}
+
+func (r Region) valid(national string) bool {
+	if len(national) < r.Min || len(national) > r.Max {
+		return false
+	}
+	// where the trunk prefix is 0 no number starts with it
+	return r.Trunk != "0" || national[0] != '0'
+}
+
+func (r Region) lengths() string {
+	if r.Min == r.Max {
+		return fmt.Sprint(r.Min)
+	}
+	return fmt.Sprintf("%d to %d", r.Min, r.Max)
+}
@@ -0,0 +1,81 @@
+package phone
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		number string
+		region string
+		want   string
+	}{
+		// trunk prefix in parentheses or left in after the country code
+		{"+44 (0)20 7946 0018", "", "+442079460018"},
+		{"+44 020 7946 0018", "", "+442079460018"},
+		{"+61 (0)412 345 678", "", "+61412345678"},
+		// national numbers in the region
+		{"020 7946 0018", "GB", "+442079460018"},
+		{"0701-234 567", "se", "+46701234567"},
+		{"(415) 555-2671", "US", "+14155552671"},
+		{"1 415 555 2671", "CA", "+14155552671"},
+		{"612 345 678", "ES", "+34612345678"},
+		// 00 is the international prefix
+		{"0046 70 123 45 67", "", "+46701234567"},
+		{"0044 (0)20 7946 0018", "US", "+442079460018"},
+		// countries we have no rules for are plain E.164
+		{"+84 912 345 678", "", "+84912345678"},
+		{"+886 912 345 678", "", "+886912345678"},
+		{"+20 100 123 4567", "", "+201001234567"},
+		{"0084 912 345 678", "GB", "+84912345678"},
+	}
+	for _, test := range tests {
+		got, err := Normalize(test.number, test.region)
+		if err != nil || got != test.want {
+			t.Errorf("Normalize(%q, %q) = %q, %v, want %q", test.number, test.region, got, err, test.want)
+		}
+	}
+}
+
+func TestNormalizeInvalid(t *testing.T) {
+	tests := []struct {
+		number string
+		region string
+	}{
+		{"", "SE"},
+		{"070 123 45 67", ""},
+		{"070 123 45 67", "XX"},
+		{"call me", "SE"},
+		// too short and too long for the region
+		{"+46 70", ""},
+		{"+44 20 7946 0018 99", ""},
+		{"0701", "SE"},
+		// and for the world
+		{"+84 123", ""},
+		{"+84 1234 5678 9012 3456", ""},
+		{"+8", ""},
+	}
+	for _, test := range tests {
+		if got, err := Normalize(test.number, test.region); err == nil {
+			t.Errorf("Normalize(%q, %q) = %q, want an error", test.number, test.region, got)
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"+46701234567", "+467******67"},
+		{"+84912345678", "+849******78"},
+		{"+1234567", "+123**67"},
+		{"+123456", "*******"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := Mask(test.number); got != test.want {
+			t.Errorf("Mask(%q) = %q, want %q", test.number, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"ninja/phone"
+)
+
+// plainUser is User without the bson hooks below.
+type plainUser User
+
+// userDoc is how a user is stored. With phone keys set phone holds the
+// blind index of the number and phone_enc the sealed number, so the unique
+// index and lookups by phone work without opening anything.
+type userDoc struct {
+	Record   plainUser `bson:",inline"`
+	PhoneEnc string    `bson:"phone_enc,omitempty"`
+}
+
+// SetupPhoneKeys loads PHONE_KEYS, without them numbers are stored as is.
+func SetupPhoneKeys() {
+	if Env.Vars.PhoneKeys == "" {
+		return
+	}
+	keys, err := phone.ParseKeyring(Env.Vars.PhoneKeys, Env.Vars.PhoneIndexKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	Env.PhoneKeys = keys
+}
+
+// PhoneIndex is what a number is stored and looked up as.
+func PhoneIndex(number string) string {
+	if Env.PhoneKeys == nil || number == "" {
+		return number
+	}
+	return Env.PhoneKeys.Index(number)
+}
+
+// phoneFields are the stored fields of number.
+func phoneFields(number string) (Fields, error) {
+	if Env.PhoneKeys == nil || number == "" {
+		return Fields{"phone": number}, nil
+	}
+	sealed, err := Env.PhoneKeys.Seal(number)
+	if err != nil {
+		return nil, err
+	}
+	return Fields{"phone": PhoneIndex(number), "phone_enc": sealed}, nil
+}
+
+// userFields are fields the way UpdateUser stores them. A phone number is
+// sealed like SaveUser would, an empty one is left out and cleared is true,
+// it has to be removed instead. Fields that are already sealed, from Rekey,
+// are left alone.
+func userFields(fields Fields) (Fields, bool, error) {
+	number, ok := fields["phone"].(string)
+	if _, sealed := fields["phone_enc"]; !ok || sealed {
+		return fields, false, nil
+	}
+
+	out := Fields{}
+	for k, v := range fields {
+		if k != "phone" {
+			out[k] = v
+		}
+	}
+	if number == "" {
+		return out, true, nil
+	}
+	stored, err := phoneFields(number)
+	if err != nil {
+		return nil, false, err
+	}
+	for k, v := range stored {
+		out[k] = v
+	}
+	return out, false, nil
+}
+
+func (u User) GetBSON() (interface{}, error) {
+	doc := userDoc{Record: plainUser(u)}
+	if Env.PhoneKeys == nil || u.Phone == "" {
+		return doc, nil
+	}
+
+	// no need to seal it again if it hasn't changed
+	if number, err := Env.PhoneKeys.Open(u.phoneSealed); err == nil && number == u.Phone {
+		doc.Record.Phone = PhoneIndex(u.Phone)
+		doc.PhoneEnc = u.phoneSealed
+		return doc, nil
+	}
+
+	fields, err := phoneFields(u.Phone)
+	if err != nil {
+		return nil, err
+	}
+	doc.Record.Phone = fields["phone"].(string)
+	doc.PhoneEnc = fields["phone_enc"].(string)
+	return doc, nil
+}
+
+func (u *User) SetBSON(raw bson.Raw) error {
+	doc := userDoc{}
+	if err := raw.Unmarshal(&doc); err != nil {
+		return err
+	}
+	*u = User(doc.Record)
+	if doc.PhoneEnc == "" {
+		// from before there were keys
+		return nil
+	}
+
+	if Env.PhoneKeys == nil {
+		return errors.New(fmt.Sprintf("The phone number of %s is encrypted but PHONE_KEYS isn't set", u.Id.Hex()))
+	}
+	number, err := Env.PhoneKeys.Open(doc.PhoneEnc)
+	if err != nil {
+		return err
+	}
+	u.Phone = number
+	u.phoneSealed = doc.PhoneEnc
+	return nil
+}
+
+// Rekey seals every number again with the current key, including ones from
+// before there were keys, and returns how many it changed. Users are updated
+// one at a time so it can run next to the bot.
+func Rekey(store Store) (int, error) {
+	changed := 0
+	err := store.EachUser(func(user *User) error {
+		if user.Phone == "" || phone.KeyId(user.phoneSealed) == Env.PhoneKeys.Current {
+			return nil
+		}
+		fields, err := phoneFields(user.Phone)
+		if err != nil {
+			return err
+		}
+		if err := store.UpdateUser(user.Id, fields); err != nil {
+			return err
+		}
+		changed++
+		return nil
+	})
+	return changed, err
+}
+
+// RunRekey is `ninja rekey`, run it after putting a new key in front of
+// PHONE_KEYS, after that the old key can go.
+func RunRekey() {
+	if Env.PhoneKeys == nil {
+		log.Fatal("Set PHONE_KEYS and PHONE_INDEX_KEY first")
+	}
+
+	store, err := OpenStore(StoreURL())
+	if err != nil {
+		log.Fatal(err)
+	}
+	changed, err := Rekey(store)
+	if err != nil {
+		log.Fatalf("Sealed %d numbers again before failing: %s", changed, err)
+	}
+	log.Infof("Sealed %d numbers with key %s", changed, Env.PhoneKeys.Current)
+}
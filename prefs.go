@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"ninja/chat"
+	"ninja/notify"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefs are how a user wants to hear about runs.
+type Prefs struct {
+	// Muted users aren't mentioned when runs start or are about to end.
+	Muted bool `bson:"muted"`
+	// Cafe limits mentions to runs to that cafe.
+	Cafe string `bson:"cafe"`
+	// QuietFrom and QuietTo are hours in the user's timezone, no quiet hours
+	// when they're the same.
+	QuietFrom int `bson:"quiet_from"`
+	QuietTo   int `bson:"quiet_to"`
+	// Summary is the provider people who ordered get the run summary by,
+	// nothing if empty.
+	Summary string `bson:"summary"`
+}
+
+// Location is the user's timezone, UTC if we don't know it.
+func (u *User) Location() *time.Location {
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Quiet reports whether it's the user's quiet hours at now.
+func (u *User) Quiet(now time.Time) bool {
+	from, to := u.Prefs.QuietFrom, u.Prefs.QuietTo
+	if from == to {
+		return false
+	}
+	hour := now.In(u.Location()).Hour()
+	if from < to {
+		return hour >= from && hour < to
+	}
+	// over midnight
+	return hour >= from || hour < to
+}
+
+// Subscribed reports whether user wants to be mentioned about run at now.
+func (u *User) Subscribed(run *Run, now time.Time) bool {
+	if u.Id == run.Runner || u.Deleted || u.Prefs.Muted || u.Quiet(now) {
+		return false
+	}
+	if u.Runner && !u.Running(now) {
+		// on a break
+		return false
+	}
+	if u.Prefs.Cafe != "" && !strings.EqualFold(u.Prefs.Cafe, run.Cafe) {
+		return false
+	}
+	return true
+}
+
+// channelUsers is everyone in the channel of run, with the ones who haven't
+// talked to the bot yet as users that aren't stored. When the adapter can't
+// list the channel it's everyone in the team the bot knows.
+func channelUsers(adapter chat.Adapter, run *Run) ([]User, error) {
+	users, err := Env.Store.TeamUsers(run.TeamId)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := adapter.ChannelMembers(run.TeamId, run.Channel)
+	if err != nil {
+		if err != chat.ErrUnsupported {
+			log.Warn("Could not list the channel, mentioning the team instead: ", err)
+		}
+		return users, nil
+	}
+
+	known := map[string]*User{}
+	for i := range users {
+		if users[i].Platform == run.Platform {
+			known[users[i].UserId] = &users[i]
+		}
+	}
+	in := []User{}
+	for _, member := range members {
+		if user, ok := known[member.Id]; ok {
+			in = append(in, *user)
+			continue
+		}
+		in = append(in, User{
+			Platform: run.Platform,
+			TeamId:   run.TeamId,
+			UserId:   member.Id,
+			Username: member.Name,
+			Deleted:  member.Deleted,
+		})
+	}
+	return in, nil
+}
+
+// Mentions addresses everyone in the channel of run who wants to hear about
+// it, except the users in skip.
+func Mentions(run *Run, skip map[string]bool) string {
+	adapter, err := AdapterFor(run.Platform)
+	if err != nil {
+		log.Warn("No adapter to mention people with: ", err)
+		return ""
+	}
+
+	users, err := channelUsers(adapter, run)
+	if err != nil {
+		log.Warn("Could not look up who to mention: ", err)
+		return ""
+	}
+
+	now := time.Now()
+	mentions := []string{}
+	for i := range users {
+		if users[i].Platform == run.Platform && users[i].Subscribed(run, now) && !skip[users[i].Id.Hex()] {
+			mentions = append(mentions, adapter.Mention(users[i].UserId, users[i].Username))
+		}
+	}
+
+	if len(mentions) == 0 {
+		return ""
+	}
+	return strings.Join(mentions, " ") + " "
+}
+
+// SendSummaries tells people who ordered and asked for it that their order
+// is on its way.
+func SendSummaries(run *Run, runner *User, from string) {
+	owners := map[string][]string{}
+	ids := []bson.ObjectId{}
+	for _, item := range run.Items {
+		if _, ok := owners[item.OwnerId.Hex()]; !ok {
+			ids = append(ids, item.OwnerId)
+		}
+		owners[item.OwnerId.Hex()] = append(owners[item.OwnerId.Hex()], item.Name)
+	}
+
+	users, err := Env.Store.Users(ids)
+	if err != nil {
+		log.Warn("Could not look up who wants a summary: ", err)
+		return
+	}
+
+	for i := range users {
+		user := &users[i]
+		if user.Prefs.Summary == "" || user.Id == runner.Id {
+			continue
+		}
+		note := notify.Notification{
+			From:    from,
+			Subject: "Your coffee",
+			Text:    fmt.Sprintf("%s is fetching your %s.", runner.Name, strings.Join(owners[user.Id.Hex()], " and ")),
+		}
+		if _, err := Env.Notifier.Send(user.Prefs.Summary, Recipient(user), &note); err != nil {
+			log.Warnf("Could not send summary to %s: %s", user.Name, err)
+		}
+	}
+}
+
+func PrefsCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	announcements := "on"
+	if user.Prefs.Muted {
+		announcements = "muted"
+	}
+	cafe := "any"
+	if user.Prefs.Cafe != "" {
+		cafe = user.Prefs.Cafe
+	}
+	quiet := "off"
+	if user.Prefs.QuietFrom != user.Prefs.QuietTo {
+		quiet = fmt.Sprintf("%d-%d (%s)", user.Prefs.QuietFrom, user.Prefs.QuietTo, user.Location())
+	}
+	summary := "off"
+	if user.Prefs.Summary != "" {
+		summary = user.Prefs.Summary
+	}
+
+	return chat.EphemeralReply(fmt.Sprintf("```"+
+		"\n%-20s %s"+
+		"\n%-20s %s"+
+		"\n%-20s %s"+
+		"\n%-20s %s```",
+		"announcements", announcements, "cafe", cafe, "quiet", quiet, "summary", summary,
+	))
+}
+
+func MuteCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	user.Prefs.Muted = args["mute"] == "mute"
+	if err := Env.Store.UpdateUser(user.Id, Fields{"prefs": user.Prefs}); err != nil {
+		return ErrorReply(err)
+	}
+
+	if user.Prefs.Muted {
+		return chat.EphemeralReply("Ok, I won't mention you when runs start. `unmute` to change your mind.")
+	}
+	return chat.EphemeralReply("Ok, I'll mention you when runs start.")
+}
+
+func CafeCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	cafe := strings.TrimSpace(args["cafe"])
+	if strings.EqualFold(cafe, "any") {
+		cafe = ""
+	}
+
+	user.Prefs.Cafe = cafe
+	if err := Env.Store.UpdateUser(user.Id, Fields{"prefs": user.Prefs}); err != nil {
+		return ErrorReply(err)
+	}
+
+	if cafe == "" {
+		return chat.EphemeralReply("Ok, I'll mention you for runs to any cafe.")
+	}
+	return chat.EphemeralReply(fmt.Sprintf("Ok, I'll only mention you for runs to %s.", cafe))
+}
+
+func QuietCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	from, to := 0, 0
+	if args["hours"] != "off" {
+		hours := strings.Split(args["hours"], "-")
+		var err error
+		if len(hours) == 2 {
+			if from, err = strconv.Atoi(hours[0]); err == nil {
+				to, err = strconv.Atoi(hours[1])
+			}
+		}
+		if len(hours) != 2 || err != nil || from < 0 || from > 23 || to < 0 || to > 23 {
+			return chat.EphemeralReply("Quiet hours go like `quiet 22-7`, from and to in your timezone.")
+		}
+	}
+
+	user.Prefs.QuietFrom, user.Prefs.QuietTo = from, to
+	if err := Env.Store.UpdateUser(user.Id, Fields{"prefs": user.Prefs}); err != nil {
+		return ErrorReply(err)
+	}
+
+	if from == to {
+		return chat.EphemeralReply("Ok, no quiet hours.")
+	}
+	return chat.EphemeralReply(fmt.Sprintf("Ok, I won't mention you from %d to %d (%s).", from, to, user.Location()))
+}
+
+func SummaryCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	provider := args["provider"]
+	if provider == "off" {
+		provider = ""
+	} else if !Env.Notifier.Known(provider) {
+		return chat.EphemeralReply(fmt.Sprintf("I can't send summaries by `%s`.", provider))
+	}
+
+	user.Prefs.Summary = provider
+	if err := Env.Store.UpdateUser(user.Id, Fields{"prefs": user.Prefs}); err != nil {
+		return ErrorReply(err)
+	}
+
+	if provider == "" {
+		return chat.EphemeralReply("Ok, no summaries.")
+	}
+	return chat.EphemeralReply(fmt.Sprintf("Ok, I'll let you know by %s when your order is on its way.", provider))
+}
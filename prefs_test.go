@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"ninja/chat"
+	"ninja/console"
+	"testing"
+)
+
+// channelAdapter is a console that knows who's in the channel.
+type channelAdapter struct {
+	*console.Adapter
+	members []chat.Profile
+	err     error
+}
+
+func (a *channelAdapter) ChannelMembers(teamId string, channelId string) ([]chat.Profile, error) {
+	return a.members, a.err
+}
+
+func TestMentions(t *testing.T) {
+	store := Env.Store
+	Env.Store = NewMemoryStore()
+	defer func() { Env.Store = store }()
+	adapters := Adapters
+	defer func() { Adapters = adapters }()
+
+	runner := &User{Id: bson.NewObjectId(), Platform: console.Platform, TeamId: "T1", UserId: "runner"}
+	bob := &User{Id: bson.NewObjectId(), Platform: console.Platform, TeamId: "T1", UserId: "bob"}
+	muted := &User{Id: bson.NewObjectId(), Platform: console.Platform, TeamId: "T1", UserId: "muted", Prefs: Prefs{Muted: true}}
+	elsewhere := &User{Id: bson.NewObjectId(), Platform: console.Platform, TeamId: "T1", UserId: "elsewhere"}
+	for _, u := range []*User{runner, bob, muted, elsewhere} {
+		if err := Env.Store.InsertUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := &Run{Platform: console.Platform, TeamId: "T1", Channel: "coffee", Runner: runner.Id}
+
+	adapter := &channelAdapter{Adapter: &console.Adapter{}, members: []chat.Profile{
+		{Id: "runner"}, {Id: "bob"}, {Id: "muted"}, {Id: "new"}, {Id: "gone", Deleted: true},
+	}}
+	Adapters = map[string]chat.Adapter{console.Platform: adapter}
+
+	if got := Mentions(run, nil); got != "@bob @new " {
+		t.Errorf("mentioned %q in the channel", got)
+	}
+	if got := Mentions(run, map[string]bool{bob.Id.Hex(): true}); got != "@new " {
+		t.Errorf("mentioned %q skipping bob", got)
+	}
+
+	// without a member list it's everyone the bot knows
+	for _, err := range []error{chat.ErrUnsupported, errors.New("down")} {
+		adapter.members, adapter.err = nil, err
+		if got := Mentions(run, nil); got != "@bob @elsewhere " && got != "@elsewhere @bob " {
+			t.Errorf("mentioned %q when the channel can't be listed (%s)", got, err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"ninja/chat"
+	"strings"
+	"time"
+)
+
+// ByAdmin is an admin changing someone else, the detail of the audit entry
+// is the id of the admin.
+const ByAdmin = "admin"
+
+// Forgotten is the name orders of people who asked to be forgotten go by.
+const Forgotten = "someone"
+
+// Order is something a person ordered, for PersonalData.
+type Order struct {
+	Run     bson.ObjectId `json:"run"`
+	Started time.Time     `json:"started"`
+	Cafe    string        `json:"cafe,omitempty"`
+	Item    string        `json:"item"`
+}
+
+// PersonalData is everything the bot keeps about someone.
+type PersonalData struct {
+	User   *User        `json:"user"`
+	Ran    []Run        `json:"ran"`
+	Orders []Order      `json:"orders"`
+	Audit  []AuditEntry `json:"audit"`
+}
+
+// CollectPersonalData gathers the record of user, the runs they made, what
+// they ordered and their audit trail.
+func CollectPersonalData(user *User) (*PersonalData, error) {
+	data := PersonalData{User: user, Ran: []Run{}, Orders: []Order{}}
+	// the code hash is no use to anyone
+	data.User.PhoneCode = ""
+
+	err := Env.Store.EachRun(time.Time{}, func(run *Run) error {
+		for _, item := range run.Items {
+			if item.OwnerId == user.Id {
+				data.Orders = append(data.Orders, Order{Run: run.Id, Started: run.Started, Cafe: run.Cafe, Item: item.Name})
+			}
+		}
+		if run.Runner == user.Id {
+			// what the others ordered is theirs
+			run.Items = nil
+			data.Ran = append(data.Ran, *run)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if data.Audit, err = Env.Store.AuditTrail(user.Id); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// ForgetUser erases user. Their runs and orders stay, for the stats, under a
+// new id that doesn't lead back to them, everything else about them goes.
+// Their audit trail moves to the new id too, along with the erasure.
+func ForgetUser(user *User, by string, detail string) error {
+	run, err := ActiveRun(user.TeamId)
+	if err != nil {
+		return err
+	}
+	if run != nil && run.Runner == user.Id {
+		return errors.New(fmt.Sprintf("%s is on a coffee run right now, finish it first", user.Name))
+	}
+
+	pseudonym := bson.NewObjectId()
+	err = Env.Store.EachRun(time.Time{}, func(run *Run) error {
+		fields := Fields{}
+		if run.Runner == user.Id {
+			fields["runner"] = pseudonym
+		}
+		for i := range run.Items {
+			if run.Items[i].OwnerId == user.Id {
+				run.Items[i].OwnerId = pseudonym
+				run.Items[i].OwnerName = Forgotten
+				fields["items"] = run.Items
+			}
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		return Env.Store.UpdateRun(run.Id, fields)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := Env.Store.EraseUser(user, pseudonym); err != nil {
+		return err
+	}
+	Audit(&User{Id: pseudonym, TeamId: user.TeamId, Name: Forgotten}, by, "forget", detail)
+	return nil
+}
+
+func MyDataCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	data, err := CollectPersonalData(user)
+	if err != nil {
+		return ErrorReply(err)
+	}
+	bundle, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return ErrorReply(err)
+	}
+	return chat.DirectReply("Here's everything I have on you:\n```\n" + string(bundle) + "\n```")
+}
+
+func ForgetMeCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	if args["confirm"] == "" {
+		return chat.EphemeralReply("This removes your number, name and everything else I know about you, " +
+			"your old orders stay but won't say who made them. There's no undo, say `forgetme confirm` to go ahead.")
+	}
+	if err := ForgetUser(user, ByUser, ""); err != nil {
+		return ErrorReply(err)
+	}
+	return chat.EphemeralReply("Done, I've forgotten all about you. Who are you again?")
+}
+
+// ForgetCommand is the admin version of forgetme.
+func ForgetCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	if !user.Admin {
+		return chat.EphemeralReply("Only workspace admins can make me forget other people.")
+	}
+
+	// a mention, <@U123> or <@U123|name> on slack and @name elsewhere
+	who := strings.Trim(args["user"], "<>")
+	who = strings.TrimPrefix(strings.SplitN(who, "|", 2)[0], "@")
+
+	forget, err := Env.Store.FindUser(m.TeamId, who)
+	if err == ErrNotFound {
+		users, err := Env.Store.TeamUsers(m.TeamId)
+		if err != nil {
+			return ErrorReply(err)
+		}
+		for i := range users {
+			if users[i].Username == who {
+				forget = &users[i]
+			}
+		}
+	} else if err != nil {
+		return ErrorReply(err)
+	}
+	if forget == nil {
+		return chat.EphemeralReply(fmt.Sprintf("I don't know anyone called %s.", who))
+	}
+
+	if err := ForgetUser(forget, ByAdmin, user.Id.Hex()); err != nil {
+		return ErrorReply(err)
+	}
+	return chat.EphemeralReply(fmt.Sprintf("Done, I've forgotten all about %s.", who))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"ninja/chat"
+	"sort"
+	"strings"
+)
+
+// DefaultEmoji maps reactions to orders in channels that haven't set up
+// their own, channel settings are layered on top of these.
+var DefaultEmoji = map[string]string{
+	"coffee": "usual",
+	"tea":    "english breakfast",
+}
+
+// ChannelEmoji returns the reaction to order mapping for a channel.
+func ChannelEmoji(teamId string, channelId string) (map[string]string, error) {
+	channel, err := GetChannel(teamId, channelId)
+	if err != nil {
+		return nil, err
+	}
+
+	emoji := make(map[string]string)
+	for k, v := range DefaultEmoji {
+		emoji[k] = v
+	}
+	for k, v := range channel.Emoji {
+		if v == "" {
+			delete(emoji, k)
+		} else {
+			emoji[k] = v
+		}
+	}
+
+	return emoji, nil
+}
+
+func EmojiListCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	emoji, err := ChannelEmoji(m.TeamId, m.ChannelId)
+	if err != nil {
+		return ErrorReply(err)
+	}
+
+	if len(emoji) == 0 {
+		return chat.EphemeralReply("No order emoji set up here, add one with `emoji :<emoji>: <coffee type>`")
+	}
+
+	names := make([]string, 0, len(emoji))
+	for k := range emoji {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	msg := "React to the run announcement to order:\n"
+	for i := 0; i < len(names); i++ {
+		msg += fmt.Sprintf("\n:%s: %s", names[i], emoji[names[i]])
+	}
+
+	return chat.EphemeralReply(msg)
+}
+
+func EmojiCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	if m.Direct {
+		return chat.NewReply("Order emoji are set up per channel, do that in the channel you run from.")
+	}
+
+	channel, err := GetChannel(m.TeamId, m.ChannelId)
+	if err != nil {
+		return ErrorReply(err)
+	}
+
+	name := args["emoji"]
+	item := strings.TrimSpace(args["item"])
+
+	var msg string
+	if strings.ToLower(item) == "none" {
+		channel.Emoji[name] = ""
+		msg = fmt.Sprintf("Ok, :%s: won't order anything any more.", name)
+	} else {
+		channel.Emoji[name] = item
+		msg = fmt.Sprintf("Ok, react with :%s: to order a %s.", name, item)
+	}
+
+	if err := Env.Store.SaveChannel(channel); err != nil {
+		return ErrorReply(err)
+	}
+
+	return chat.NewReply(msg)
+}
+
+// ReactionHandler orders or cancels drinks when people react to the
+// announcement of the active run.
+func ReactionHandler(r *chat.Reaction) *chat.Reply {
+	run, err := ActiveRun(r.TeamId)
+	if err != nil {
+		log.Warn("Could not load run for reaction: ", err)
+		return nil
+	}
+
+	if run == nil || run.ThreadTs == "" || run.ThreadTs != r.MessageId || run.Channel != r.ChannelId {
+		return nil
+	}
+
+	emoji, err := ChannelEmoji(run.TeamId, run.Channel)
+	if err != nil {
+		return ErrorReply(err)
+	}
+
+	name, ok := emoji[r.Emoji]
+	if !ok {
+		return nil
+	}
+
+	user, err := GetUser(&chat.Message{Platform: r.Platform, TeamId: r.TeamId, UserId: r.UserId})
+	if err != nil {
+		return ErrorReply(err)
+	}
+
+	if !r.Added {
+		item, err := CancelOrder(user, run, r.Emoji)
+		if err != nil {
+			return ErrorReply(err)
+		}
+		if item == nil {
+			return nil
+		}
+		return ThreadMessage(run, fmt.Sprintf("%s doesn't want a %s any more", user.Name, item.Name))
+	}
+
+	item, err := PlaceOrder(user, run, name, r.Emoji)
+	if err == ErrNoUsual {
+		return chat.EphemeralReply(err.Error())
+	} else if err != nil {
+		return ErrorReply(err)
+	}
+
+	return ThreadMessage(run, fmt.Sprintf("%s wants a %s", user.Name, item.Name))
+}
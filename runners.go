@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bitbucket.org/ckvist/twilio/twiml"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"ninja/chat"
+	"strings"
+	"time"
+)
+
+// Keywords twilio treats as opting out of and back into texts.
+var (
+	StopWords  = []string{"stop", "stopall", "unsubscribe", "cancel", "end", "quit"}
+	StartWords = []string{"start", "yes", "unstop"}
+)
+
+// Running reports whether user is a runner that isn't on a break.
+func (u *User) Running(now time.Time) bool {
+	return u.Runner && !now.Before(u.PausedUntil)
+}
+
+// ParseDate reads a date like 2016-12-24 or a weekday, which is the next one
+// after now. The date starts at midnight in loc.
+func ParseDate(s string, now time.Time, loc *time.Location) (time.Time, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	now = now.In(loc)
+
+	if date, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return date, nil
+	}
+
+	for d := 1; d <= 7; d++ {
+		day := now.AddDate(0, 0, d)
+		if strings.ToLower(day.Weekday().String()) == s {
+			return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc), nil
+		}
+	}
+
+	return time.Time{}, errors.New(fmt.Sprintf("Can't read %s as a date", s))
+}
+
+func UnregisterCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	if !user.Runner && user.Phone == "" {
+		return chat.DirectReply("You're not registered, nothing to forget.")
+	}
+
+	user.Phone = ""
+	user.PhoneValid = false
+	user.PhoneCode = ""
+	user.SMSStopped = false
+	user.Runner = false
+	user.PausedUntil = time.Time{}
+
+	if err := Env.Store.SaveUser(user); err != nil {
+		return ErrorReply(err)
+	}
+	Audit(user, ByUser, "unregister", "")
+
+	return chat.DirectReply("Ok, I've forgotten your number and you're not a runner anymore.")
+}
+
+func PauseCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	if !user.Runner {
+		return chat.DirectReply("You're not a runner, no need for a break!")
+	}
+
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	until, err := ParseDate(args["date"], time.Now(), loc)
+	if err != nil {
+		return chat.DirectReply("I don't get that date, try something like `2016-12-24` or `monday`.")
+	}
+	if !until.After(time.Now()) {
+		return chat.DirectReply("That's in the past, I can't help you there.")
+	}
+
+	if err := Env.Store.UpdateUser(user.Id, Fields{"paused_until": until}); err != nil {
+		return ErrorReply(err)
+	}
+	Audit(user, ByUser, "pause", until.Format("2006-01-02"))
+
+	return chat.DirectReply(fmt.Sprintf("Enjoy the break! I'll leave you alone until %s.", until.Format("Monday January 2")))
+}
+
+func ResumeCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	if user.Running(time.Now()) {
+		return chat.DirectReply("You're not on a break.")
+	}
+	if !user.Runner {
+		return chat.DirectReply("You need to `register` to become a runner.")
+	}
+
+	if err := Env.Store.UpdateUser(user.Id, Fields{"paused_until": time.Time{}}); err != nil {
+		return ErrorReply(err)
+	}
+	Audit(user, ByUser, "resume", "")
+
+	return chat.DirectReply("Welcome back!")
+}
+
+func isWord(words []string, s string) bool {
+	for _, w := range words {
+		if w == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SMSHandler gets texts sent to our number, twilio handles the replies to
+// STOP and START, we stop texting numbers that opted out.
+func SMSHandler(w http.ResponseWriter, r *http.Request) {
+	from := r.PostFormValue("From")
+	body := strings.ToLower(strings.TrimSpace(r.PostFormValue("Body")))
+
+	stop := isWord(StopWords, body)
+	if stop || isWord(StartWords, body) {
+		user, err := Env.Store.FindUserByPhone(from)
+		if err == nil {
+			if err := Env.Store.UpdateUser(user.Id, Fields{"sms_stopped": stop}); err != nil {
+				log.Warn("Could not update texting opt out: ", err)
+				http.Error(w, "Could not update user", http.StatusInternalServerError)
+				return
+			}
+			if stop {
+				Audit(user, BySMS, "stop sms", body)
+			} else {
+				Audit(user, BySMS, "start sms", body)
+			}
+		} else if err != ErrNotFound {
+			log.Warn("Could not look up texter: ", err)
+			http.Error(w, "Could not look up user", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		log.Infof("Ignoring text from %s", from)
+	}
+
+	twiml.NewResponse().Send(w)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// SeenTTL is how long we remember handled messages, slack gives up retrying
+// long before this.
+const SeenTTL = 24 * time.Hour
+
+type SeenMessage struct {
+	Key     string    `bson:"_id"`
+	Created time.Time `bson:"created"`
+}
+
+// Seen records that the message identified by key is being handled and
+// reports whether it was already handled before.
+func Seen(key string) bool {
+	seen, err := Env.Store.Seen(key)
+	if err != nil {
+		// better to risk a duplicate than to drop the message
+		log.Warn("Could not record message: ", err)
+	}
+	return seen
+}
@@ -0,0 +1,122 @@
+package slack
+
+import (
+	"ninja/chat"
+)
+
+// Adapter plugs a Bot into the platform neutral chat package.
+type Adapter struct {
+	Bot *Bot
+}
+
+func NewAdapter(b *Bot) *Adapter {
+	return &Adapter{Bot: b}
+}
+
+func (a *Adapter) Platform() string {
+	return "slack"
+}
+
+func (a *Adapter) Receive(messages chat.MessageHandler, reactions chat.ReactionHandler) {
+	a.Bot.MessageHandler = func(m *IncomingMessage) *OutgoingMessage {
+		return outgoing(messages(a.incoming(m)))
+	}
+	a.Bot.ReactionHandler = func(r *Reaction) *OutgoingMessage {
+		return outgoing(reactions(&chat.Reaction{
+			Platform:  a.Platform(),
+			TeamId:    r.TeamId,
+			UserId:    r.UserId,
+			Emoji:     r.Emoji,
+			ChannelId: r.ChannelId,
+			MessageId: r.Ts,
+			Added:     r.Added,
+		}))
+	}
+}
+
+// Send delivers a reply. Messages to the channel go through the incoming
+// webhook when there's no channel id, or no token to use the api with.
+func (a *Adapter) Send(to *chat.Message, reply *chat.Reply) (string, error) {
+	m := outgoing(reply)
+	if m.Visibility == Channel && m.ThreadTs == "" {
+		if to.ChannelId == "" || a.Bot.Team(to.TeamId).APIToken == "" {
+			return "", a.Bot.SendMessage(m)
+		}
+	}
+
+	in := IncomingMessage{
+		ChannelId: to.ChannelId,
+		TeamId:    to.TeamId,
+		UserId:    to.UserId,
+	}
+	if to.Direct {
+		in.ChannelName = "directmessage"
+	}
+
+	return a.Bot.Reply(&in, m)
+}
+
+func (a *Adapter) LookupUser(teamId string, userId string) (*chat.Profile, error) {
+	bot := a.Bot.Team(teamId)
+	if bot.APIToken == "" {
+		// profiles need the web api
+		return nil, chat.ErrUnsupported
+	}
+	return bot.UserInfo(userId)
+}
+
+func (a *Adapter) ChannelMembers(teamId string, channelId string) ([]chat.Profile, error) {
+	bot := a.Bot.Team(teamId)
+	if bot.APIToken == "" {
+		return nil, chat.ErrUnsupported
+	}
+	members, err := bot.Members(channelId)
+	if err != nil {
+		return nil, err
+	}
+	profiles := make([]chat.Profile, len(members))
+	for i, id := range members {
+		profiles[i].Id = id
+	}
+	return profiles, nil
+}
+
+func (a *Adapter) Mention(userId string, username string) string {
+	return "<@" + userId + ">"
+}
+
+func (a *Adapter) incoming(m *IncomingMessage) *chat.Message {
+	return &chat.Message{
+		Platform:  a.Platform(),
+		TeamId:    m.TeamId,
+		ChannelId: m.ChannelId,
+		Direct:    m.IsDirect(),
+		UserId:    m.UserId,
+		UserName:  m.UserName,
+		Text:      m.Text,
+		Id:        m.Key(),
+	}
+}
+
+func outgoing(reply *chat.Reply) *OutgoingMessage {
+	if reply == nil {
+		return nil
+	}
+
+	m := &OutgoingMessage{
+		Text:      reply.Text,
+		ThreadTs:  reply.ThreadId,
+		Broadcast: reply.Broadcast,
+	}
+
+	switch reply.Visibility {
+	case chat.Ephemeral:
+		m.Visibility = Ephemeral
+	case chat.Direct:
+		m.Visibility = Direct
+	default:
+		m.Visibility = Channel
+	}
+
+	return m
+}
@@ -0,0 +1,207 @@
+package slack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/url"
+	"ninja/chat"
+)
+
+const APIUrl string = "https://slack.com/api/"
+
+type apiResponse struct {
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Ts      string `json:"ts"`
+	Channel struct {
+		Id string `json:"id"`
+	} `json:"channel"`
+	User             *userInfo `json:"user"`
+	UserId           string    `json:"user_id"`
+	Members          []string  `json:"members"`
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+type userInfo struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Deleted  bool   `json:"deleted"`
+	RealName string `json:"real_name"`
+	Tz       string `json:"tz"`
+	IsAdmin  bool   `json:"is_admin"`
+	IsOwner  bool   `json:"is_owner"`
+	Profile  struct {
+		DisplayName string `json:"display_name"`
+		RealName    string `json:"real_name"`
+		Image       string `json:"image_192"`
+		Email       string `json:"email"`
+	} `json:"profile"`
+}
+
+// call invokes a slack web api method and decodes the response into res.
+func (b *Bot) call(method string, params url.Values, res *apiResponse) error {
+	if b.APIToken == "" {
+		return errors.New("No api token configured")
+	}
+
+	params.Set("token", b.APIToken)
+
+	resp, err := HTTPClient.PostForm(APIUrl+method, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return err
+	}
+
+	if !res.Ok {
+		return errors.New(fmt.Sprintf("%s failed: %s", method, res.Error))
+	}
+
+	return nil
+}
+
+func messageParams(channel string, m *OutgoingMessage) url.Values {
+	params := url.Values{}
+	params.Set("channel", channel)
+	params.Set("text", m.Text)
+	params.Set("as_user", "true")
+	if m.UseMarkdown {
+		params.Set("mrkdwn", "true")
+	}
+	if m.ThreadTs != "" {
+		params.Set("thread_ts", m.ThreadTs)
+		if m.Broadcast {
+			params.Set("reply_broadcast", "true")
+		}
+	}
+	return params
+}
+
+// PostMessage posts a message to a channel using the web api and returns
+// the timestamp of the new message.
+func (b *Bot) PostMessage(channel string, m *OutgoingMessage) (string, error) {
+	var res apiResponse
+	if err := b.call("chat.postMessage", messageParams(channel, m), &res); err != nil {
+		return "", err
+	}
+	log.Debugf("Posted message to %s: %+v", channel, m)
+	return res.Ts, nil
+}
+
+// PostEphemeral posts a message in a channel that only user can see.
+func (b *Bot) PostEphemeral(channel string, user string, m *OutgoingMessage) error {
+	params := messageParams(channel, m)
+	params.Set("user", user)
+	var res apiResponse
+	if err := b.call("chat.postEphemeral", params, &res); err != nil {
+		return err
+	}
+	log.Debugf("Posted ephemeral message to %s in %s: %+v", user, channel, m)
+	return nil
+}
+
+// OpenDirect opens a direct message channel with user and returns its id.
+func (b *Bot) OpenDirect(user string) (string, error) {
+	params := url.Values{}
+	params.Set("users", user)
+	var res apiResponse
+	if err := b.call("conversations.open", params, &res); err != nil {
+		return "", err
+	}
+	return res.Channel.Id, nil
+}
+
+// UserInfo looks up the profile of a user.
+func (b *Bot) UserInfo(user string) (*chat.Profile, error) {
+	params := url.Values{}
+	params.Set("user", user)
+	var res apiResponse
+	if err := b.call("users.info", params, &res); err != nil {
+		return nil, err
+	}
+	if res.User == nil {
+		return nil, errors.New("users.info returned no user")
+	}
+
+	info := res.User
+	profile := chat.Profile{
+		Id:          info.Id,
+		Name:        info.Name,
+		DisplayName: info.Profile.DisplayName,
+		RealName:    info.Profile.RealName,
+		Avatar:      info.Profile.Image,
+		Email:       info.Profile.Email,
+		Timezone:    info.Tz,
+		Deleted:     info.Deleted,
+		Admin:       info.IsAdmin || info.IsOwner,
+	}
+	if profile.RealName == "" {
+		profile.RealName = info.RealName
+	}
+
+	return &profile, nil
+}
+
+// Members lists the users in channel, not counting the bot.
+func (b *Bot) Members(channel string) ([]string, error) {
+	var self apiResponse
+	if err := b.call("auth.test", url.Values{}, &self); err != nil {
+		return nil, err
+	}
+
+	members := []string{}
+	cursor := ""
+	for {
+		params := url.Values{}
+		params.Set("channel", channel)
+		params.Set("limit", "1000")
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		var res apiResponse
+		if err := b.call("conversations.members", params, &res); err != nil {
+			return nil, err
+		}
+		for _, member := range res.Members {
+			if member != self.UserId {
+				members = append(members, member)
+			}
+		}
+		if cursor = res.ResponseMetadata.NextCursor; cursor == "" {
+			return members, nil
+		}
+	}
+}
+
+// Reply delivers m as a response to the incoming message to, honouring
+// the visibility of the reply. Returns the timestamp of the new message
+// unless it was ephemeral.
+func (b *Bot) Reply(to *IncomingMessage, m *OutgoingMessage) (string, error) {
+	b = b.Team(to.TeamId)
+	switch m.Visibility {
+	case Ephemeral:
+		if to.IsDirect() {
+			return b.PostMessage(to.ChannelId, m)
+		}
+		return "", b.PostEphemeral(to.ChannelId, to.UserId, m)
+	case Direct:
+		channel, err := b.OpenDirect(to.UserId)
+		if err != nil {
+			return "", err
+		}
+		return b.PostMessage(channel, m)
+	default:
+		return b.PostMessage(to.ChannelId, m)
+	}
+}
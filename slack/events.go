@@ -0,0 +1,237 @@
+package slack
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureWindow is how old a signed request can be, anything older could
+// be a replay.
+const SignatureWindow = 5 * time.Minute
+
+// VerifySignature checks the X-Slack-Signature of a request, made by slack
+// from the signing secret, the timestamp and the body.
+func VerifySignature(secret string, timestamp string, signature string, body []byte, now time.Time) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("slack: missing or invalid request timestamp")
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > SignatureWindow || age < -SignatureWindow {
+		return errors.New("slack: request timestamp is too far off")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errors.New("slack: invalid request signature")
+	}
+	return nil
+}
+
+type EventCallback struct {
+	Token     string          `json:"token"`
+	TeamId    string          `json:"team_id"`
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	EventId   string          `json:"event_id"`
+	Event     json.RawMessage `json:"event"`
+}
+
+type MessageEvent struct {
+	Type        string `json:"type"`
+	Subtype     string `json:"subtype"`
+	Channel     string `json:"channel"`
+	ChannelType string `json:"channel_type"`
+	User        string `json:"user"`
+	BotId       string `json:"bot_id"`
+	Text        string `json:"text"`
+	Ts          string `json:"ts"`
+}
+
+type ReactionEvent struct {
+	Type     string `json:"type"`
+	User     string `json:"user"`
+	Reaction string `json:"reaction"`
+	Item     struct {
+		Type    string `json:"type"`
+		Channel string `json:"channel"`
+		Ts      string `json:"ts"`
+	} `json:"item"`
+}
+
+// Reaction is an emoji being added to or removed from a message.
+type Reaction struct {
+	TeamId    string
+	UserId    string
+	Emoji     string
+	ChannelId string
+	Ts        string
+	Added     bool
+}
+
+// EventsHandler receives callbacks from the slack events api. Teams that
+// installed the bot through oauth send all their messages here, teams using
+// the outgoing webhook only send direct messages and reactions.
+func (b *Bot) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not supported", http.StatusBadRequest)
+		log.Warnf("Got a %s request to events handler.", r.Method)
+		return
+	}
+
+	// events are where commands come from so they have to be signed
+	if b.SigningSecret == "" {
+		http.Error(w, "Events are not set up", http.StatusForbidden)
+		log.Warn("Got a slack event but there is no signing secret to check it with")
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid post body", http.StatusBadRequest)
+		return
+	}
+	err = VerifySignature(b.SigningSecret, r.Header.Get("X-Slack-Request-Timestamp"),
+		r.Header.Get("X-Slack-Signature"), body, time.Now())
+	if err != nil {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		log.Warnf("Got slack event with %s from %s", err, r.RemoteAddr)
+		return
+	}
+
+	var callback EventCallback
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&callback); err != nil {
+		http.Error(w, "Invalid post body", http.StatusBadRequest)
+		log.Warn("Could not decode slack event: ", err)
+		return
+	}
+
+	switch callback.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(callback.Challenge))
+	case "event_callback":
+		if b.seen(callback.EventId) {
+			log.Infof("Discarding retried event %s", callback.EventId)
+			return
+		}
+		// slack wants an answer within three seconds so do the work after
+		// acking the event
+		go b.handleEvent(&callback)
+	default:
+		log.Debugf("Ignoring slack callback of type %s", callback.Type)
+	}
+}
+
+func (b *Bot) handleEvent(callback *EventCallback) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(callback.Event, &head); err != nil {
+		log.Warn("Could not decode slack event: ", err)
+		return
+	}
+
+	switch head.Type {
+	case "message":
+		b.handleMessageEvent(callback)
+	case "reaction_added", "reaction_removed":
+		b.handleReactionEvent(callback)
+	default:
+		log.Debugf("Ignoring %s event", head.Type)
+	}
+}
+
+func (b *Bot) handleMessageEvent(callback *EventCallback) {
+	var event MessageEvent
+	if err := json.Unmarshal(callback.Event, &event); err != nil {
+		log.Warn("Could not decode slack event: ", err)
+		return
+	}
+
+	// ignore edits, joins and our own messages
+	if event.Subtype != "" || event.BotId != "" || event.User == "" {
+		return
+	}
+
+	channelName := ""
+	if event.ChannelType == "im" {
+		channelName = "directmessage"
+	}
+
+	message := IncomingMessage{
+		ChannelId:   event.Channel,
+		ChannelName: channelName,
+		TeamId:      callback.TeamId,
+		Text:        event.Text,
+		Timestamp:   event.Ts,
+		UserId:      event.User,
+		EventId:     callback.EventId,
+	}
+
+	log.Debugf("Got chat message: %+v", message)
+
+	if b.seen(message.Key()) {
+		log.Infof("Discarding message %s, it was already handled", message.Key())
+		return
+	}
+
+	if b.MessageHandler != nil {
+		b.dispatch(&message)
+	}
+}
+
+func (b *Bot) handleReactionEvent(callback *EventCallback) {
+	var event ReactionEvent
+	if err := json.Unmarshal(callback.Event, &event); err != nil {
+		log.Warn("Could not decode slack event: ", err)
+		return
+	}
+
+	if event.Item.Type != "message" {
+		return
+	}
+
+	// skin tone variations count as the same emoji
+	emoji := event.Reaction
+	if i := strings.Index(emoji, "::"); i != -1 {
+		emoji = emoji[:i]
+	}
+
+	reaction := Reaction{
+		TeamId:    callback.TeamId,
+		UserId:    event.User,
+		Emoji:     emoji,
+		ChannelId: event.Item.Channel,
+		Ts:        event.Item.Ts,
+		Added:     event.Type == "reaction_added",
+	}
+
+	log.Debugf("Got reaction: %+v", reaction)
+
+	if b.ReactionHandler != nil {
+		response := b.ReactionHandler(&reaction)
+		if response != nil {
+			to := IncomingMessage{
+				ChannelId: reaction.ChannelId,
+				TeamId:    reaction.TeamId,
+				UserId:    reaction.UserId,
+			}
+			if _, err := b.Reply(&to, response); err != nil {
+				log.Warn("Could not send reply: ", err)
+			}
+		}
+	}
+}
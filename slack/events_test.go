@@ -0,0 +1,77 @@
+package slack
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the example from https://api.slack.com/authentication/verifying-requests-from-slack
+const (
+	exampleSecret    = "8f742231b10e8888abcd99yyyzzz85a5"
+	exampleTimestamp = "1531420618"
+	exampleBody      = "token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&team_domain=testteamnow&channel_id=G8PSS9T3V&" +
+		"channel_name=foobar&user_id=U2CERLKJA&user_name=roadrunner&command=%2Fwebhook-collect&text=&" +
+		"response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2FT1DC2JH3J%2F397700885554%2F96rGlfmibIGlgcZRskXaIFfN&" +
+		"trigger_id=398738663015.47445629121.803a0bc887a14d10d2c447fce8b6703c"
+	exampleSignature = "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503"
+)
+
+func sign(secret string, timestamp string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	at := time.Unix(1531420618, 0).Add(time.Minute)
+
+	if err := VerifySignature(exampleSecret, exampleTimestamp, exampleSignature, []byte(exampleBody), at); err != nil {
+		t.Errorf("example request: %s", err)
+	}
+
+	tampered := strings.Replace(exampleBody, "U2CERLKJA", "U2CERLKJB", 1)
+	if err := VerifySignature(exampleSecret, exampleTimestamp, exampleSignature, []byte(tampered), at); err == nil {
+		t.Error("accepted a tampered body")
+	}
+	if err := VerifySignature("wrong", exampleTimestamp, exampleSignature, []byte(exampleBody), at); err == nil {
+		t.Error("accepted the wrong secret")
+	}
+	if err := VerifySignature(exampleSecret, exampleTimestamp, exampleSignature, []byte(exampleBody), at.Add(time.Hour)); err == nil {
+		t.Error("accepted an old request")
+	}
+	if err := VerifySignature(exampleSecret, "", exampleSignature, []byte(exampleBody), at); err == nil {
+		t.Error("accepted a request without a timestamp")
+	}
+}
+
+func TestEventsHandlerSignature(t *testing.T) {
+	body := `{"type":"url_verification","challenge":"abc"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	post := func(b *Bot, signature string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/slack/events", strings.NewReader(body))
+		r.Header.Set("X-Slack-Request-Timestamp", now)
+		r.Header.Set("X-Slack-Signature", signature)
+		w := httptest.NewRecorder()
+		b.EventsHandler(w, r)
+		return w
+	}
+
+	if w := post(&Bot{}, sign("secret", now, body)); w.Code != http.StatusForbidden {
+		t.Errorf("without a signing secret got %d", w.Code)
+	}
+	if w := post(&Bot{SigningSecret: "secret"}, sign("other", now, body)); w.Code != http.StatusForbidden {
+		t.Errorf("with a bad signature got %d", w.Code)
+	}
+	w := post(&Bot{SigningSecret: "secret"}, sign("secret", now, body))
+	if w.Code != http.StatusOK || w.Body.String() != "abc" {
+		t.Errorf("signed challenge got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,98 @@
+package slack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const AuthorizeUrl string = "https://slack.com/oauth/v2/authorize"
+
+// Scopes the bot asks for when it's installed.
+var Scopes = []string{
+	"channels:history",
+	"channels:read",
+	"chat:write",
+	"groups:history",
+	"groups:read",
+	"im:history",
+	"im:write",
+	"reactions:read",
+	"users:read",
+	"users:read.email",
+}
+
+// OAuthApp is the slack app used for the "Add to Slack" install flow.
+type OAuthApp struct {
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+}
+
+// Installation is what we get back when a team installs the bot.
+type Installation struct {
+	TeamId    string
+	TeamName  string
+	BotToken  string
+	BotUserId string
+	Scope     string
+}
+
+// AuthorizeURL returns the url to send someone installing the bot to.
+func (a *OAuthApp) AuthorizeURL(state string) string {
+	params := url.Values{}
+	params.Set("client_id", a.ClientId)
+	params.Set("scope", strings.Join(Scopes, ","))
+	params.Set("redirect_uri", a.RedirectUrl)
+	params.Set("state", state)
+	return AuthorizeUrl + "?" + params.Encode()
+}
+
+// Exchange trades the code slack redirected back with for a bot token.
+func (a *OAuthApp) Exchange(code string) (*Installation, error) {
+	params := url.Values{}
+	params.Set("client_id", a.ClientId)
+	params.Set("client_secret", a.ClientSecret)
+	params.Set("code", code)
+	params.Set("redirect_uri", a.RedirectUrl)
+
+	resp, err := HTTPClient.PostForm(APIUrl+"oauth.v2.access", params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Ok          bool   `json:"ok"`
+		Error       string `json:"error"`
+		AccessToken string `json:"access_token"`
+		Scope       string `json:"scope"`
+		BotUserId   string `json:"bot_user_id"`
+		Team        struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"team"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+
+	if !res.Ok {
+		return nil, errors.New(fmt.Sprintf("oauth.v2.access failed: %s", res.Error))
+	}
+
+	return &Installation{
+		TeamId:    res.Team.Id,
+		TeamName:  res.Team.Name,
+		BotToken:  res.AccessToken,
+		BotUserId: res.BotUserId,
+		Scope:     res.Scope,
+	}, nil
+}
@@ -8,43 +8,150 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/ajg/form"
 	"net/http"
+	"ninja/chat"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const UrlTemplate string = "https://%s.slack.com/services/hooks/incoming-webhook?token=%s"
 
+// NoPrivateReplies goes to the channel in place of a private reply when
+// there's no api token to send it with.
+const NoPrivateReplies = "I can only answer that privately and I don't have an api token for this workspace, " +
+	"ask whoever set me up to add one."
+
+// HTTPClient is used for all requests to slack.
+var HTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if seconds <= 0 {
+			seconds = 1
+		}
+		return &chat.RateLimitError{RetryAfter: time.Duration(seconds) * time.Second}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Unexpected response code %d", resp.StatusCode))
+	}
+	return nil
+}
+
 type IncomingMessage struct {
-	ChannelId   string  `form:"channel_id"`
-	ChannelName string  `form:"channel_name"`
-	ServiceId   string  `form:"service_id"`
-	TeamDomain  string  `form:"team_domain"`
-	TeamId      string  `form:"team_id"`
-	Text        string  `form:"text"`
-	Timestamp   float32 `form:"timestamp"`
-	Token       string  `form:"token"`
-	TriggerWord string  `form:"trigger_word"`
-	UserId      string  `form:"user_id"`
-	UserName    string  `form:"user_name"`
+	ChannelId   string `form:"channel_id"`
+	ChannelName string `form:"channel_name"`
+	ServiceId   string `form:"service_id"`
+	TeamDomain  string `form:"team_domain"`
+	TeamId      string `form:"team_id"`
+	Text        string `form:"text"`
+	Timestamp   string `form:"timestamp"`
+	Token       string `form:"token"`
+	TriggerWord string `form:"trigger_word"`
+	UserId      string `form:"user_id"`
+	UserName    string `form:"user_name"`
+	EventId     string `form:"-"`
 }
 
+// Visibility controls who gets to see a reply.
+type Visibility int
+
+const (
+	// Posted to the channel the message came from.
+	Channel Visibility = iota
+	// Only shown to the user who sent the message.
+	Ephemeral
+	// Sent as a direct message to the user.
+	Direct
+)
+
 type OutgoingMessage struct {
-	Channel     string `json:"channel,omitempty"`
-	From        string `json:"username,omitempty"`
-	Text        string `json:"text"`
-	UseMarkdown bool   `json:"mrkdwn,omitempty"`
+	Channel     string     `json:"channel,omitempty"`
+	From        string     `json:"username,omitempty"`
+	Text        string     `json:"text"`
+	UseMarkdown bool       `json:"mrkdwn,omitempty"`
+	ThreadTs    string     `json:"thread_ts,omitempty"`
+	Broadcast   bool       `json:"reply_broadcast,omitempty"`
+	Visibility  Visibility `json:"-"`
 }
 
 type Bot struct {
-	Subdomain      string
-	Token          string
-	MessageHandler func(m *IncomingMessage) *OutgoingMessage
+	Subdomain string
+	Token     string
+	APIToken  string
+	// SigningSecret checks that events really come from slack.
+	SigningSecret   string
+	MessageHandler  func(m *IncomingMessage) *OutgoingMessage
+	ReactionHandler func(r *Reaction) *OutgoingMessage
+	// Seen is asked about every message and event before it's handled and
+	// should report whether it has been handled before. Slack retries
+	// deliveries it thinks failed so we can get the same message twice.
+	Seen func(key string) bool
+	// TeamToken looks up the api token of a team that installed the bot,
+	// APIToken is used for teams it returns nothing for.
+	TeamToken func(teamId string) string
+}
+
+// Team returns a bot that talks to slack on behalf of team.
+func (b *Bot) Team(teamId string) *Bot {
+	if b.TeamToken == nil || teamId == "" {
+		return b
+	}
+	token := b.TeamToken(teamId)
+	if token == "" {
+		return b
+	}
+	team := *b
+	team.APIToken = token
+	return &team
+}
+
+// Key identifies a message across retries, and across the webhook and
+// events api if a message arrives through both.
+func (m *IncomingMessage) Key() string {
+	if m.Timestamp == "" {
+		return m.EventId
+	}
+	return m.TeamId + "/" + m.ChannelId + "/" + m.Timestamp
+}
+
+// seen reports whether the message identified by key has been handled.
+func (b *Bot) seen(key string) bool {
+	if b.Seen == nil || key == "" {
+		return false
+	}
+	return b.Seen(key)
+}
+
+// dispatch handles a message and replies through the web api.
+func (b *Bot) dispatch(message *IncomingMessage) {
+	response := b.MessageHandler(message)
+	if response != nil {
+		if _, err := b.Reply(message, response); err != nil {
+			log.Warn("Could not send reply: ", err)
+		}
+	}
+}
+
+// IsDirect reports whether the message was sent in a direct message channel.
+func (m *IncomingMessage) IsDirect() bool {
+	return m.ChannelName == "directmessage" || strings.HasPrefix(m.ChannelId, "D")
 }
 
 func NewMessage(msg string) *OutgoingMessage {
 	return &OutgoingMessage{Text: msg}
 }
 
+func EphemeralMessage(msg string) *OutgoingMessage {
+	return &OutgoingMessage{Text: msg, Visibility: Ephemeral}
+}
+
+func DirectMessage(msg string) *OutgoingMessage {
+	return &OutgoingMessage{Text: msg, Visibility: Direct}
+}
+
 func ErrorMessage(err error) *OutgoingMessage {
-	return NewMessage(fmt.Sprintf("ERROR: %s", err))
+	return EphemeralMessage(fmt.Sprintf("ERROR: %s", err))
 }
 
 func (b *Bot) SendMessage(m *OutgoingMessage) (err error) {
@@ -63,13 +170,14 @@ func (b *Bot) SendMessage(m *OutgoingMessage) (err error) {
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := HTTPClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("Unexpected response code %d", resp.StatusCode))
+	if err := checkResponse(resp); err != nil {
+		return err
 	}
 
 	log.Debugf("Sent message: %+v", m)
@@ -100,9 +208,30 @@ func (b *Bot) SlackHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Debugf("Got chat message: %+v", message)
 
-	if b.MessageHandler != nil {
+	if b.seen(message.Key()) {
+		log.Infof("Discarding retried message %s", message.Key())
+		return
+	}
+
+	if b.MessageHandler != nil && b.Team(message.TeamId).APIToken != "" {
+		// ack right away so slack doesn't retry while we are busy, the
+		// reply goes through the web api when we're done
+		go b.dispatch(&message)
+	} else if b.MessageHandler != nil {
 		response := b.MessageHandler(&message)
-		if response != nil {
+		private := response != nil && (response.Visibility != Channel || response.ThreadTs != "")
+		if private && b.Team(message.TeamId).APIToken != "" {
+			// webhook responses always go to the channel, private and
+			// threaded replies have to go through the web api
+			if _, err := b.Reply(&message, response); err != nil {
+				log.Warn("Could not send reply: ", err)
+			}
+		} else if response != nil {
+			if response.Visibility != Channel {
+				// what's meant for one person never goes to the channel
+				log.Warnf("No api token for %s, can't answer %s privately", message.TeamId, message.UserId)
+				response = NewMessage(NoPrivateReplies)
+			}
 			w.Header().Set("Content-Type", "application/json")
 			encoder := json.NewEncoder(w)
 			if err := encoder.Encode(&response); err != nil {
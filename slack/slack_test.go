@@ -0,0 +1,65 @@
+package slack
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func post(b *Bot) string {
+	form := url.Values{"team_id": {"T1"}, "channel_id": {"C1"}, "user_id": {"U1"}, "text": {"help"}}
+	r := httptest.NewRequest("POST", "/slack", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	b.SlackHandler(w, r)
+	return w.Body.String()
+}
+
+func TestSlackHandlerWithoutAPIToken(t *testing.T) {
+	b := &Bot{MessageHandler: func(m *IncomingMessage) *OutgoingMessage {
+		return NewMessage("coffee time")
+	}}
+	if body := post(b); !strings.Contains(body, "coffee time") {
+		t.Errorf("the reply didn't come back in the response: %q", body)
+	}
+
+	// private replies can't go through the webhook response, it's public
+	for _, private := range []*OutgoingMessage{
+		ErrorMessage(errors.New("nope")),
+		EphemeralMessage("your code is 1234"),
+		{Text: "your number is +46701234567", Visibility: Direct},
+	} {
+		private := private
+		b.MessageHandler = func(m *IncomingMessage) *OutgoingMessage { return private }
+		body := post(b)
+		if strings.Contains(body, private.Text) {
+			t.Errorf("a private reply went to the channel: %q", body)
+		}
+		if !strings.Contains(body, "api token") {
+			t.Errorf("no word on why there's no answer: %q", body)
+		}
+	}
+}
+
+func TestSlackHandlerAcksTeams(t *testing.T) {
+	release := make(chan bool)
+	handled := make(chan bool, 1)
+	b := &Bot{
+		TeamToken: func(teamId string) string { return "xoxb-" + teamId },
+		MessageHandler: func(m *IncomingMessage) *OutgoingMessage {
+			<-release
+			handled <- true
+			return nil
+		},
+	}
+
+	// a team installed through oauth gets an ack right away even without
+	// a token of our own, the reply goes through the web api later
+	if body := post(b); body != "" {
+		t.Errorf("responded %q", body)
+	}
+	close(release)
+	<-handled
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ErrNotFound is returned by stores when there's nothing matching.
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate is returned when a record would clash with another one, like
+// two users with the same phone number.
+var ErrDuplicate = errors.New("duplicate")
+
+// ErrUnavailable is returned when the store can't be reached at the moment.
+var ErrUnavailable = errors.New("store unavailable")
+
+// Fields is a partial update, keyed by the bson names of top level fields.
+type Fields map[string]interface{}
+
+// Store is where the bot keeps everything. MongoStore is the real one,
+// MemoryStore keeps things around until the process exits.
+type Store interface {
+	User(id bson.ObjectId) (*User, error)
+	FindUser(teamId string, userId string) (*User, error)
+	// ClaimLegacyUser moves a user from before there were teams into teamId.
+	ClaimLegacyUser(teamId string, userId string) (*User, error)
+	Users(ids []bson.ObjectId) ([]User, error)
+	InsertUser(user *User) error
+	SaveUser(user *User) error
+	UpdateUser(id bson.ObjectId, fields Fields) error
+	// AddCodeAttempt counts a try at the verification code of a user and
+	// returns how many there have been.
+	AddCodeAttempt(id bson.ObjectId) (int, error)
+	FindUserByPhone(phone string) (*User, error)
+	TeamUsers(teamId string) ([]User, error)
+
+	Run(id bson.ObjectId) (*Run, error)
+	ActiveRun(teamId string) (*Run, error)
+	ActiveRuns() ([]Run, error)
+	InsertRun(run *Run) error
+	UpdateRun(id bson.ObjectId, fields Fields) error
+	// EndRun marks a run as no longer active and returns it, ErrNotFound
+	// means it wasn't active to begin with.
+	EndRun(id bson.ObjectId, ended time.Time) (*Run, error)
+	AddItem(runId bson.ObjectId, item Item) error
+	RemoveItem(runId bson.ObjectId, ownerId bson.ObjectId, reaction string) error
+
+	FindChannel(teamId string, channelId string) (*Channel, error)
+	SaveChannel(channel *Channel) error
+
+	FindTeam(teamId string) (*Team, error)
+	SaveTeam(team *Team) error
+
+	// Seen records key and reports whether it was recorded before.
+	Seen(key string) (bool, error)
+
+	Enqueue(msg *OutboxMessage) error
+	// ClaimOutbox hands out the next message that is due, or one whose
+	// claim has timed out.
+	ClaimOutbox(now time.Time) (*OutboxMessage, error)
+	UpdateOutbox(id bson.ObjectId, fields Fields) error
+
+	InsertDelivery(d *Delivery) error
+	// LastDelivery is the latest delivery of kind to a number.
+	LastDelivery(to string, kind string) (*Delivery, error)
+	// SetDeliveryStatus updates a delivery that isn't final yet and returns
+	// it as it was before.
+	SetDeliveryStatus(sid string, status string, errorCode string, updated time.Time) (*Delivery, error)
+
+	InsertAudit(entry *AuditEntry) error
+	// AuditTrail is everything recorded about a user, oldest first.
+	AuditTrail(user bson.ObjectId) ([]AuditEntry, error)
+
+	// EraseUser removes a user, the texts sent to them and the messages
+	// waiting in the outbox for them. Their audit entries stay but lose
+	// their details and move to pseudonym.
+	EraseUser(user *User, pseudonym bson.ObjectId) error
+
+	// EachUser calls fn with every user and EachRun with every run started
+	// since, oldest first, stopping at the first error. They don't load
+	// everything at once.
+	EachUser(fn func(user *User) error) error
+	EachRun(since time.Time, fn func(run *Run) error) error
+
+	// Snapshot is everything in the store.
+	Snapshot() (*Snapshot, error)
+	// Restore adds everything in snap, replacing records with the same id.
+	Restore(snap *Snapshot) error
+
+	// Setup prepares the store, e.g. creates indexes.
+	Setup() error
+}
+
+// Snapshot is the contents of a store, for copying between stores.
+type Snapshot struct {
+	Users      []User          `bson:"users"`
+	Runs       []Run           `bson:"runs"`
+	Channels   []Channel       `bson:"channels"`
+	Teams      []Team          `bson:"teams"`
+	Seen       []SeenMessage   `bson:"seen"`
+	Outbox     []OutboxMessage `bson:"outbox"`
+	Deliveries []Delivery      `bson:"deliveries"`
+	Audit      []AuditEntry    `bson:"audit"`
+}
+
+// StoreURL is where the bot keeps things, MONGOHQ_URL is from before there
+// were other stores.
+func StoreURL() string {
+	if Env.Vars.StoreURL != "" {
+		return Env.Vars.StoreURL
+	}
+	return Env.Vars.MongoURL
+}
+
+// OpenStore opens the store at rawurl, the scheme picks the kind of store:
+// mongodb://host/db, file:///path/to/ninja.db or memory://.
+func OpenStore(rawurl string) (Store, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "mongodb":
+		// an empty name is the database in the url
+		return DialMongo(rawurl, Env.Vars.MongoDB)
+	case "file":
+		if u.Path == "" {
+			return nil, errors.New("File store needs a path, e.g. file:///var/lib/ninja.db")
+		}
+		return NewFileStore(u.Path)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Unknown store %s", u.Scheme))
+}
+
+// CopyStore adds everything in from to to.
+func CopyStore(from Store, to Store) error {
+	snap, err := from.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := to.Setup(); err != nil {
+		return err
+	}
+	return to.Restore(snap)
+}
+
+// RunCopyStore is `ninja copy-store <from url> <to url>`, for moving between
+// mongo and a file.
+func RunCopyStore(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: ninja copy-store <from url> <to url>")
+		os.Exit(2)
+	}
+
+	from, err := OpenStore(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	to, err := OpenStore(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := CopyStore(from, to); err != nil {
+		log.Fatal(err)
+	}
+
+	snap, _ := to.Snapshot()
+	if snap != nil {
+		log.Infof("%s now has %d users and %d runs", args[1], len(snap.Users), len(snap.Runs))
+	}
+}
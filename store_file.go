@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FileCompactAfter is how many changes are appended to a store file before
+// it's written out again from scratch.
+const FileCompactAfter = 10000
+
+// fileRecord is a record as it's written to a store file, without a doc it
+// was removed.
+type fileRecord struct {
+	Kind string    `bson:"kind"`
+	Id   string    `bson:"id"`
+	Doc  *bson.Raw `bson:"doc,omitempty"`
+}
+
+// fileEntry is what store files are made of, a snapshot followed by a
+// change for every write since. Files from before there were changes are a
+// single Snapshot.
+type fileEntry struct {
+	Snapshot *Snapshot    `bson:"snapshot,omitempty"`
+	Changes  []fileRecord `bson:"changes,omitempty"`
+}
+
+// NewFileStore is a MemoryStore kept in a single file at path, for running
+// without a database. Every change appends just the records it touched to
+// the file, and the file is written out again from scratch every
+// FileCompactAfter changes. Only one process can have it open, path.lock
+// keeps the others out.
+func NewFileStore(path string) (*MemoryStore, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, errors.New(fmt.Sprintf("%s is in use by another ninja, stop it first", path))
+	}
+
+	s := NewMemoryStore()
+	s.path = path
+	s.lock = lock
+	if err := s.open(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// open loads the file and opens it for appending, a file that isn't there
+// yet starts out as an empty snapshot.
+func (s *MemoryStore) open() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s.compact()
+	} else if err != nil {
+		return err
+	}
+
+	read, err := s.load(data)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s isn't a ninja store or it's damaged, leaving it alone: %s", s.path, err))
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if read < len(data) {
+		// a crash halfway through a write, the change never happened
+		log.Warnf("%s ends with a change that was cut short, leaving it out", s.path)
+		if err := file.Truncate(int64(read)); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	s.file = file
+	return nil
+}
+
+// Close lets go of the file of a file store, changes fail with
+// ErrUnavailable after this.
+func (s *MemoryStore) Close() {
+	s.Lock()
+	defer s.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if s.lock != nil {
+		s.lock.Close()
+		s.lock = nil
+	}
+}
+
+// load reads the entries of a store file into s and returns how much of
+// data they take up. Only a change cut short at the end is left out,
+// anything else that doesn't read is an error so a file that isn't ours is
+// never written over.
+func (s *MemoryStore) load(data []byte) (int, error) {
+	read := 0
+	for read < len(data) {
+		rest := data[read:]
+		if len(rest) < 4 || int(binary.LittleEndian.Uint32(rest)) > len(rest) {
+			if read == 0 {
+				return 0, errors.New("it doesn't start with a snapshot")
+			}
+			return read, nil
+		}
+		size := int(binary.LittleEndian.Uint32(rest))
+		if size < 5 {
+			return read, errors.New(fmt.Sprintf("there's an entry of %d bytes at %d", size, read))
+		}
+
+		entry := fileEntry{}
+		if err := bson.Unmarshal(rest[:size], &entry); err != nil {
+			return read, err
+		}
+		switch {
+		case entry.Snapshot != nil:
+			s.restore(entry.Snapshot)
+		case entry.Changes != nil && read > 0:
+			for _, r := range entry.Changes {
+				if err := s.apply(r); err != nil {
+					return read, err
+				}
+			}
+			s.appended++
+		case read == 0:
+			// files from before there were changes are a bare snapshot
+			doc := bson.M{}
+			if err := bson.Unmarshal(rest[:size], &doc); err != nil {
+				return read, err
+			}
+			if _, ok := doc["users"]; !ok {
+				return read, errors.New("it doesn't start with a snapshot")
+			}
+			snap := Snapshot{}
+			if err := bson.Unmarshal(rest[:size], &snap); err != nil {
+				return read, err
+			}
+			s.restore(&snap)
+		default:
+			return read, errors.New(fmt.Sprintf("there's an entry at %d that isn't a change", read))
+		}
+		read += size
+	}
+	return read, nil
+}
+
+// record is the stored record of key as it goes in a file.
+func (s *MemoryStore) record(key recordKey) (fileRecord, error) {
+	var doc interface{}
+	switch key.Kind {
+	case "users":
+		if user, ok := s.users[bson.ObjectIdHex(key.Id)]; ok {
+			doc = user
+		}
+	case "runs":
+		if run, ok := s.runs[bson.ObjectIdHex(key.Id)]; ok {
+			doc = run
+		}
+	case "channels":
+		if channel, ok := s.channels[bson.ObjectIdHex(key.Id)]; ok {
+			doc = channel
+		}
+	case "teams":
+		if team, ok := s.teams[bson.ObjectIdHex(key.Id)]; ok {
+			doc = team
+		}
+	case "seen":
+		if created, ok := s.seen[key.Id]; ok {
+			doc = &SeenMessage{Key: key.Id, Created: created}
+		}
+	case "outbox":
+		if msg, ok := s.outbox[bson.ObjectIdHex(key.Id)]; ok {
+			doc = msg
+		}
+	case "deliveries":
+		if d, ok := s.delivery[key.Id]; ok {
+			doc = d
+		}
+	case "audit":
+		for i := range s.audit {
+			if s.audit[i].Id.Hex() == key.Id {
+				doc = &s.audit[i]
+			}
+		}
+	default:
+		return fileRecord{}, errors.New(fmt.Sprintf("No %s in the store", key.Kind))
+	}
+
+	r := fileRecord{Kind: key.Kind, Id: key.Id}
+	if doc == nil {
+		return r, nil
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return r, err
+	}
+	r.Doc = &bson.Raw{Kind: 0x03, Data: data}
+	return r, nil
+}
+
+// apply puts a record read from a file in the store.
+func (s *MemoryStore) apply(r fileRecord) error {
+	removed := r.Doc == nil
+	switch r.Kind {
+	case "users":
+		delete(s.users, bson.ObjectIdHex(r.Id))
+		if !removed {
+			user := User{}
+			s.users[bson.ObjectIdHex(r.Id)] = &user
+			return r.Doc.Unmarshal(&user)
+		}
+	case "runs":
+		delete(s.runs, bson.ObjectIdHex(r.Id))
+		if !removed {
+			run := Run{}
+			s.runs[bson.ObjectIdHex(r.Id)] = &run
+			return r.Doc.Unmarshal(&run)
+		}
+	case "channels":
+		delete(s.channels, bson.ObjectIdHex(r.Id))
+		if !removed {
+			channel := Channel{}
+			s.channels[bson.ObjectIdHex(r.Id)] = &channel
+			return r.Doc.Unmarshal(&channel)
+		}
+	case "teams":
+		delete(s.teams, bson.ObjectIdHex(r.Id))
+		if !removed {
+			team := Team{}
+			s.teams[bson.ObjectIdHex(r.Id)] = &team
+			return r.Doc.Unmarshal(&team)
+		}
+	case "seen":
+		delete(s.seen, r.Id)
+		if !removed {
+			seen := SeenMessage{}
+			if err := r.Doc.Unmarshal(&seen); err != nil {
+				return err
+			}
+			s.seen[r.Id] = seen.Created
+		}
+	case "outbox":
+		delete(s.outbox, bson.ObjectIdHex(r.Id))
+		if !removed {
+			msg := OutboxMessage{}
+			s.outbox[bson.ObjectIdHex(r.Id)] = &msg
+			return r.Doc.Unmarshal(&msg)
+		}
+	case "deliveries":
+		delete(s.delivery, r.Id)
+		if !removed {
+			d := Delivery{}
+			s.delivery[r.Id] = &d
+			return r.Doc.Unmarshal(&d)
+		}
+	case "audit":
+		audit := s.audit[:0]
+		for _, entry := range s.audit {
+			if entry.Id.Hex() != r.Id {
+				audit = append(audit, entry)
+			}
+		}
+		s.audit = audit
+		if !removed {
+			entry := AuditEntry{}
+			if err := r.Doc.Unmarshal(&entry); err != nil {
+				return err
+			}
+			s.audit = append(s.audit, entry)
+		}
+	default:
+		return errors.New(fmt.Sprintf("Can't read a %s record, is the file from a newer ninja?", r.Kind))
+	}
+	return nil
+}
+
+// append adds a change with the records of keys to the end of the file. The
+// change is one bson document so it's either all there or, after a crash,
+// cut short and left out by load.
+func (s *MemoryStore) append(keys []recordKey) error {
+	entry := fileEntry{Changes: []fileRecord{}}
+	for _, key := range keys {
+		r, err := s.record(key)
+		if err != nil {
+			return err
+		}
+		entry.Changes = append(entry.Changes, r)
+	}
+	data, err := bson.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(data)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// don't leave a half written change in the middle of the file
+		if compactErr := s.compact(); compactErr != nil {
+			log.Warn("Could not write the store again after a failed write: ", compactErr)
+		}
+		return err
+	}
+	s.appended++
+	return nil
+}
+
+// compact writes the whole store to a new file in place of the old one, and
+// opens it for appending.
+func (s *MemoryStore) compact() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := writeSnapshot(s.path, &fileEntry{Snapshot: s.snapshot()}); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.appended = 0
+	return nil
+}
+
+// writeSnapshot replaces the file at path with doc, a crash halfway leaves
+// the old file in place.
+func writeSnapshot(path string, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"ninja/phone"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in maps. Records go through bson on the way
+// in and out so callers never share them, and so they come back the way
+// mongo would return them. With a path, every change is written to that file,
+// see NewFileStore.
+type MemoryStore struct {
+	sync.Mutex
+	path     string
+	file     *os.File
+	lock     *os.File
+	appended int
+	users    map[bson.ObjectId]*User
+	runs     map[bson.ObjectId]*Run
+	channels map[bson.ObjectId]*Channel
+	teams    map[bson.ObjectId]*Team
+	seen     map[string]time.Time
+	outbox   map[bson.ObjectId]*OutboxMessage
+	delivery map[string]*Delivery
+	audit    []AuditEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:    make(map[bson.ObjectId]*User),
+		runs:     make(map[bson.ObjectId]*Run),
+		channels: make(map[bson.ObjectId]*Channel),
+		teams:    make(map[bson.ObjectId]*Team),
+		seen:     make(map[string]time.Time),
+		outbox:   make(map[bson.ObjectId]*OutboxMessage),
+		delivery: make(map[string]*Delivery),
+	}
+}
+
+// clone copies in to out through bson.
+func clone(in interface{}, out interface{}) {
+	data, err := bson.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	if err := bson.Unmarshal(data, out); err != nil {
+		panic(err)
+	}
+}
+
+// update applies fields to doc the way $set does.
+func update(doc interface{}, fields Fields) {
+	m := bson.M{}
+	clone(doc, &m)
+	for k, v := range fields {
+		m[k] = v
+	}
+	target := reflect.ValueOf(doc).Elem()
+	target.Set(reflect.Zero(target.Type()))
+	clone(m, doc)
+}
+
+func (s *MemoryStore) User(id bson.ObjectId) (*User, error) {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user := User{}
+	clone(stored, &user)
+	return &user, nil
+}
+
+func (s *MemoryStore) FindUser(teamId string, userId string) (*User, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, stored := range s.users {
+		if stored.TeamId == teamId && stored.UserId == userId {
+			user := User{}
+			clone(stored, &user)
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) ClaimLegacyUser(teamId string, userId string) (*User, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, stored := range s.users {
+		if stored.TeamId == "" && stored.UserId == userId {
+			stored.TeamId = teamId
+			user := User{}
+			clone(stored, &user)
+			return &user, s.changed(objectKey("users", stored.Id))
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) Users(ids []bson.ObjectId) ([]User, error) {
+	s.Lock()
+	defer s.Unlock()
+	users := []User{}
+	for _, id := range ids {
+		if stored, ok := s.users[id]; ok {
+			user := User{}
+			clone(stored, &user)
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// phoneTaken reports whether a user other than id has the number stored as
+// phone, see PhoneIndex.
+func (s *MemoryStore) phoneTaken(id bson.ObjectId, phone interface{}) bool {
+	for _, stored := range s.users {
+		if stored.Id != id && stored.Phone != "" && PhoneIndex(stored.Phone) == phone {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) InsertUser(user *User) error {
+	s.Lock()
+	defer s.Unlock()
+	if user.Id == "" {
+		user.Id = bson.NewObjectId()
+	}
+	if s.phoneTaken(user.Id, PhoneIndex(user.Phone)) {
+		return ErrDuplicate
+	}
+	for _, stored := range s.users {
+		if stored.TeamId == user.TeamId && stored.UserId == user.UserId {
+			return ErrDuplicate
+		}
+	}
+	stored := User{}
+	clone(user, &stored)
+	s.users[user.Id] = &stored
+	return s.changed(objectKey("users", user.Id))
+}
+
+func (s *MemoryStore) SaveUser(user *User) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.users[user.Id]; !ok {
+		return ErrNotFound
+	}
+	if s.phoneTaken(user.Id, PhoneIndex(user.Phone)) {
+		return ErrDuplicate
+	}
+	stored := User{}
+	clone(user, &stored)
+	s.users[user.Id] = &stored
+	return s.changed(objectKey("users", user.Id))
+}
+
+func (s *MemoryStore) UpdateUser(id bson.ObjectId, fields Fields) error {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	fields, cleared, err := userFields(fields)
+	if err != nil {
+		return err
+	}
+	if phone, ok := fields["phone"]; ok && s.phoneTaken(id, phone) {
+		return ErrDuplicate
+	}
+	update(stored, fields)
+	if cleared {
+		stored.Phone = ""
+		stored.phoneSealed = ""
+	}
+	return s.changed(objectKey("users", id))
+}
+
+func (s *MemoryStore) AddCodeAttempt(id bson.ObjectId) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.users[id]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	stored.CodeAttempts++
+	return stored.CodeAttempts, s.changed(objectKey("users", id))
+}
+
+func (s *MemoryStore) FindUserByPhone(phone string) (*User, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, stored := range s.users {
+		if stored.Phone != "" && stored.Phone == phone {
+			user := User{}
+			clone(stored, &user)
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) TeamUsers(teamId string) ([]User, error) {
+	s.Lock()
+	defer s.Unlock()
+	users := []User{}
+	for _, stored := range s.users {
+		if stored.TeamId == teamId {
+			user := User{}
+			clone(stored, &user)
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) Run(id bson.ObjectId) (*Run, error) {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.runs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	run := Run{}
+	clone(stored, &run)
+	return &run, nil
+}
+
+func (s *MemoryStore) ActiveRun(teamId string) (*Run, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, stored := range s.runs {
+		if stored.TeamId == teamId && stored.Active {
+			run := Run{}
+			clone(stored, &run)
+			return &run, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) ActiveRuns() ([]Run, error) {
+	s.Lock()
+	defer s.Unlock()
+	runs := []Run{}
+	for _, stored := range s.runs {
+		if stored.Active {
+			run := Run{}
+			clone(stored, &run)
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+func (s *MemoryStore) InsertRun(run *Run) error {
+	s.Lock()
+	defer s.Unlock()
+	if run.Id == "" {
+		run.Id = bson.NewObjectId()
+	}
+	stored := Run{}
+	clone(run, &stored)
+	s.runs[run.Id] = &stored
+	return s.changed(objectKey("runs", run.Id))
+}
+
+func (s *MemoryStore) UpdateRun(id bson.ObjectId, fields Fields) error {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.runs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	update(stored, fields)
+	return s.changed(objectKey("runs", id))
+}
+
+func (s *MemoryStore) EndRun(id bson.ObjectId, ended time.Time) (*Run, error) {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.runs[id]
+	if !ok || !stored.Active {
+		return nil, ErrNotFound
+	}
+	update(stored, Fields{"active": false, "ended": ended})
+	run := Run{}
+	clone(stored, &run)
+	return &run, s.changed(objectKey("runs", id))
+}
+
+func (s *MemoryStore) AddItem(runId bson.ObjectId, item Item) error {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.runs[runId]
+	if !ok {
+		return ErrNotFound
+	}
+	copied := Item{}
+	clone(item, &copied)
+	stored.Items = append(stored.Items, copied)
+	return s.changed(objectKey("runs", runId))
+}
+
+func (s *MemoryStore) RemoveItem(runId bson.ObjectId, ownerId bson.ObjectId, reaction string) error {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.runs[runId]
+	if !ok {
+		return ErrNotFound
+	}
+	items := []Item{}
+	for _, item := range stored.Items {
+		if item.OwnerId != ownerId || item.Reaction != reaction {
+			items = append(items, item)
+		}
+	}
+	stored.Items = items
+	return s.changed(objectKey("runs", runId))
+}
+
+func (s *MemoryStore) FindChannel(teamId string, channelId string) (*Channel, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, stored := range s.channels {
+		if stored.TeamId == teamId && stored.ChannelId == channelId {
+			channel := Channel{}
+			clone(stored, &channel)
+			return &channel, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) SaveChannel(channel *Channel) error {
+	s.Lock()
+	defer s.Unlock()
+	if channel.Id == "" {
+		channel.Id = bson.NewObjectId()
+	}
+	stored := Channel{}
+	clone(channel, &stored)
+	s.channels[channel.Id] = &stored
+	return s.changed(objectKey("channels", channel.Id))
+}
+
+func (s *MemoryStore) FindTeam(teamId string) (*Team, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, stored := range s.teams {
+		if stored.TeamId == teamId {
+			team := Team{}
+			clone(stored, &team)
+			return &team, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) SaveTeam(team *Team) error {
+	s.Lock()
+	defer s.Unlock()
+	if team.Id == "" {
+		team.Id = bson.NewObjectId()
+	}
+	stored := Team{}
+	clone(team, &stored)
+	s.teams[team.Id] = &stored
+	return s.changed(objectKey("teams", team.Id))
+}
+
+func (s *MemoryStore) Seen(key string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	changed := []recordKey{}
+	for k, created := range s.seen {
+		if now.Sub(created) > SeenTTL {
+			delete(s.seen, k)
+			changed = append(changed, recordKey{"seen", k})
+		}
+	}
+	if _, ok := s.seen[key]; ok {
+		if len(changed) > 0 {
+			return true, s.changed(changed...)
+		}
+		return true, nil
+	}
+	s.seen[key] = now
+	return false, s.changed(append(changed, recordKey{"seen", key})...)
+}
+
+func (s *MemoryStore) Enqueue(msg *OutboxMessage) error {
+	s.Lock()
+	defer s.Unlock()
+	if msg.Id == "" {
+		msg.Id = bson.NewObjectId()
+	}
+	stored := OutboxMessage{}
+	clone(msg, &stored)
+	s.outbox[msg.Id] = &stored
+	return s.changed(objectKey("outbox", msg.Id))
+}
+
+func (s *MemoryStore) ClaimOutbox(now time.Time) (*OutboxMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	due := []*OutboxMessage{}
+	pruned := []recordKey{}
+	for id, stored := range s.outbox {
+		if !stored.Done.IsZero() && now.Sub(stored.Done) > OutboxKeep {
+			delete(s.outbox, id)
+			pruned = append(pruned, objectKey("outbox", id))
+			continue
+		}
+		pending := stored.Status == OutboxPending && !stored.NextAttempt.After(now)
+		stuck := stored.Status == OutboxSending && stored.Claimed.Before(now.Add(-OutboxClaimTimeout))
+		if pending || stuck {
+			due = append(due, stored)
+		}
+	}
+	if len(due) == 0 {
+		if len(pruned) > 0 {
+			if err := s.changed(pruned...); err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrNotFound
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+
+	update(due[0], Fields{"status": OutboxSending, "claimed": now})
+	msg := OutboxMessage{}
+	clone(due[0], &msg)
+	return &msg, s.changed(append(pruned, objectKey("outbox", msg.Id))...)
+}
+
+func (s *MemoryStore) UpdateOutbox(id bson.ObjectId, fields Fields) error {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.outbox[id]
+	if !ok {
+		return ErrNotFound
+	}
+	update(stored, fields)
+	return s.changed(objectKey("outbox", id))
+}
+
+func (s *MemoryStore) InsertDelivery(d *Delivery) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.delivery[d.Sid]; ok {
+		return errors.New("Duplicate delivery " + d.Sid)
+	}
+	stored := Delivery{}
+	clone(d, &stored)
+	s.delivery[d.Sid] = &stored
+	return s.changed(recordKey{"deliveries", d.Sid})
+}
+
+func (s *MemoryStore) LastDelivery(to string, kind string) (*Delivery, error) {
+	s.Lock()
+	defer s.Unlock()
+	var last *Delivery
+	for _, stored := range s.delivery {
+		if stored.To == to && stored.Kind == kind && (last == nil || stored.Created.After(last.Created)) {
+			last = stored
+		}
+	}
+	if last == nil {
+		return nil, ErrNotFound
+	}
+	d := Delivery{}
+	clone(last, &d)
+	return &d, nil
+}
+
+func (s *MemoryStore) SetDeliveryStatus(sid string, status string, errorCode string, updated time.Time) (*Delivery, error) {
+	s.Lock()
+	defer s.Unlock()
+	stored, ok := s.delivery[sid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	for _, final := range DeliveryFinal {
+		if stored.Status == final {
+			return nil, ErrNotFound
+		}
+	}
+	previous := Delivery{}
+	clone(stored, &previous)
+	update(stored, Fields{"status": status, "error_code": errorCode, "updated": updated})
+	return &previous, s.changed(recordKey{"deliveries", sid})
+}
+
+func (s *MemoryStore) InsertAudit(entry *AuditEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	if entry.Id == "" {
+		entry.Id = bson.NewObjectId()
+	}
+	stored := AuditEntry{}
+	clone(entry, &stored)
+	s.audit = append(s.audit, stored)
+	return s.changed(objectKey("audit", stored.Id))
+}
+
+func (s *MemoryStore) AuditTrail(user bson.ObjectId) ([]AuditEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+	entries := []AuditEntry{}
+	for _, stored := range s.audit {
+		if stored.User == user {
+			entry := AuditEntry{}
+			clone(stored, &entry)
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
+
+func (s *MemoryStore) EraseUser(user *User, pseudonym bson.ObjectId) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.users, user.Id)
+	changed := []recordKey{objectKey("users", user.Id)}
+	for sid, d := range s.delivery {
+		if d.User == user.Id {
+			delete(s.delivery, sid)
+			changed = append(changed, recordKey{"deliveries", sid})
+		}
+	}
+	for id, msg := range s.outbox {
+		if msg.Platform == user.Platform && msg.TeamId == user.TeamId && msg.User == user.UserId {
+			delete(s.outbox, id)
+			changed = append(changed, objectKey("outbox", id))
+		}
+	}
+	for i := range s.audit {
+		if s.audit[i].User == user.Id {
+			s.audit[i].User = pseudonym
+			s.audit[i].Detail = ""
+			changed = append(changed, objectKey("audit", s.audit[i].Id))
+		}
+	}
+	return s.changed(changed...)
+}
+
+func (s *MemoryStore) EachUser(fn func(user *User) error) error {
+	s.Lock()
+	users := make([]User, 0, len(s.users))
+	for _, stored := range s.users {
+		user := User{}
+		clone(stored, &user)
+		users = append(users, user)
+	}
+	s.Unlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Id < users[j].Id })
+	for i := range users {
+		if err := fn(&users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) EachRun(since time.Time, fn func(run *Run) error) error {
+	s.Lock()
+	runs := []Run{}
+	for _, stored := range s.runs {
+		if stored.Started.Before(since) {
+			continue
+		}
+		run := Run{}
+		clone(stored, &run)
+		runs = append(runs, run)
+	}
+	s.Unlock()
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	for i := range runs {
+		if err := fn(&runs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) snapshot() *Snapshot {
+	snap := Snapshot{}
+	for _, user := range s.users {
+		snap.Users = append(snap.Users, *user)
+	}
+	for _, run := range s.runs {
+		snap.Runs = append(snap.Runs, *run)
+	}
+	for _, channel := range s.channels {
+		snap.Channels = append(snap.Channels, *channel)
+	}
+	for _, team := range s.teams {
+		snap.Teams = append(snap.Teams, *team)
+	}
+	for key, created := range s.seen {
+		snap.Seen = append(snap.Seen, SeenMessage{Key: key, Created: created})
+	}
+	for _, msg := range s.outbox {
+		snap.Outbox = append(snap.Outbox, *msg)
+	}
+	for _, d := range s.delivery {
+		snap.Deliveries = append(snap.Deliveries, *d)
+	}
+	snap.Audit = append(snap.Audit, s.audit...)
+
+	out := Snapshot{}
+	clone(&snap, &out)
+	return &out
+}
+
+func (s *MemoryStore) Snapshot() (*Snapshot, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.snapshot(), nil
+}
+
+func (s *MemoryStore) Restore(snap *Snapshot) error {
+	s.Lock()
+	defer s.Unlock()
+	s.restore(snap)
+	return s.changed()
+}
+
+func (s *MemoryStore) restore(snap *Snapshot) {
+	in := Snapshot{}
+	clone(snap, &in)
+	for i := range in.Users {
+		s.users[in.Users[i].Id] = &in.Users[i]
+	}
+	for i := range in.Runs {
+		s.runs[in.Runs[i].Id] = &in.Runs[i]
+	}
+	for i := range in.Channels {
+		s.channels[in.Channels[i].Id] = &in.Channels[i]
+	}
+	for i := range in.Teams {
+		s.teams[in.Teams[i].Id] = &in.Teams[i]
+	}
+	for _, seen := range in.Seen {
+		s.seen[seen.Key] = seen.Created
+	}
+	for i := range in.Outbox {
+		s.outbox[in.Outbox[i].Id] = &in.Outbox[i]
+	}
+	for i := range in.Deliveries {
+		s.delivery[in.Deliveries[i].Sid] = &in.Deliveries[i]
+	}
+	known := map[bson.ObjectId]bool{}
+	for _, entry := range s.audit {
+		known[entry.Id] = true
+	}
+	for _, entry := range in.Audit {
+		if !known[entry.Id] {
+			s.audit = append(s.audit, entry)
+		}
+	}
+}
+
+// recordKey names a stored record by collection and id.
+type recordKey struct {
+	Kind string
+	Id   string
+}
+
+func objectKey(kind string, id bson.ObjectId) recordKey {
+	return recordKey{kind, id.Hex()}
+}
+
+// changed writes the records that changed to the store's file, if it has
+// one, or the whole store without any. It's called with the lock held after
+// every change.
+func (s *MemoryStore) changed(keys ...recordKey) error {
+	if s.path == "" {
+		return nil
+	}
+	if s.file == nil {
+		return ErrUnavailable
+	}
+	if len(keys) == 0 || s.appended >= FileCompactAfter {
+		return s.compact()
+	}
+	return s.append(keys)
+}
+
+// Setup masks the numbers audit entries had before they were masked, like
+// the mongo migration does.
+func (s *MemoryStore) Setup() error {
+	s.Lock()
+	defer s.Unlock()
+	changed := []recordKey{}
+	for i := range s.audit {
+		entry := &s.audit[i]
+		for _, action := range PhoneActions {
+			if entry.Action == action && phone.Mask(entry.Detail) != entry.Detail {
+				entry.Detail = phone.Mask(entry.Detail)
+				changed = append(changed, objectKey("audit", entry.Id))
+			}
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return s.changed(changed...)
+}
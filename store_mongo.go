@@ -0,0 +1,558 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MongoReconnectMax is the longest we wait between tries to reach mongo.
+const MongoReconnectMax = 30 * time.Second
+
+// MongoStore keeps everything in the database DB. Every operation runs on its
+// own copy of the session so a dropped connection only fails the operation
+// that hit it, the next one gets a new socket.
+type MongoStore struct {
+	DB string
+
+	mu      sync.RWMutex
+	session *mgo.Session
+}
+
+// DialMongo connects to the mongo at url right away, for the commands that
+// have nothing to do until it's there.
+func DialMongo(url string, db string) (*MongoStore, error) {
+	session, err := mgo.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return &MongoStore{DB: db, session: session}, nil
+}
+
+// Connect dials url until it gets through, waiting a bit longer after every
+// failed try. Until then everything fails with ErrUnavailable.
+func (s *MongoStore) Connect(url string) {
+	wait := time.Second
+	for {
+		session, err := mgo.Dial(url)
+		if err == nil {
+			s.mu.Lock()
+			s.session = session
+			s.mu.Unlock()
+			return
+		}
+
+		log.Warnf("Could not reach mongo, trying again in %s: %s", wait, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > MongoReconnectMax {
+			wait = MongoReconnectMax
+		}
+	}
+}
+
+// Close closes the main session, the store is unavailable after this.
+func (s *MongoStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session != nil {
+		s.session.Close()
+		s.session = nil
+	}
+}
+
+// C is a collection on the main session, for migrations and checks that
+// want to hold on to one connection.
+func (s *MongoStore) C(name string) *mgo.Collection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.session.DB(s.DB).C(name)
+}
+
+// do runs fn with the database on a fresh copy of the session.
+func (s *MongoStore) do(fn func(db *mgo.Database) error) error {
+	s.mu.RLock()
+	if s.session == nil {
+		s.mu.RUnlock()
+		return ErrUnavailable
+	}
+	session := s.session.Copy()
+	s.mu.RUnlock()
+	defer session.Close()
+
+	return mongoErr(fn(session.DB(s.DB)))
+}
+
+func mongoErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	if _, ok := err.(net.Error); ok || err == io.EOF || err.Error() == "no reachable servers" {
+		return ErrUnavailable
+	}
+	return err
+}
+
+func (s *MongoStore) User(id bson.ObjectId) (*User, error) {
+	user := User{}
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("users").FindId(id).One(&user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) FindUser(teamId string, userId string) (*User, error) {
+	user := User{}
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("users").Find(bson.M{"team_id": teamId, "user_id": userId}).One(&user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) ClaimLegacyUser(teamId string, userId string) (*User, error) {
+	user := User{}
+	legacy := bson.M{"team_id": bson.M{"$exists": false}, "user_id": userId}
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"team_id": teamId}}, ReturnNew: true}
+	err := s.do(func(db *mgo.Database) error {
+		_, err := db.C("users").Find(legacy).Apply(change, &user)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) Users(ids []bson.ObjectId) ([]User, error) {
+	var users []User
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("users").Find(bson.M{"_id": bson.M{"$in": ids}}).All(&users)
+	})
+	return users, err
+}
+
+func (s *MongoStore) InsertUser(user *User) error {
+	return s.do(func(db *mgo.Database) error {
+		return db.C("users").Insert(user)
+	})
+}
+
+func (s *MongoStore) SaveUser(user *User) error {
+	return s.do(func(db *mgo.Database) error {
+		return db.C("users").UpdateId(user.Id, user)
+	})
+}
+
+func (s *MongoStore) UpdateUser(id bson.ObjectId, fields Fields) error {
+	fields, cleared, err := userFields(fields)
+	if err != nil {
+		return err
+	}
+	change := bson.M{"$set": bson.M(fields)}
+	if cleared {
+		// an empty phone would clash in the unique index
+		change["$unset"] = bson.M{"phone": "", "phone_enc": ""}
+		if len(fields) == 0 {
+			delete(change, "$set")
+		}
+	}
+	return s.do(func(db *mgo.Database) error {
+		return db.C("users").UpdateId(id, change)
+	})
+}
+
+func (s *MongoStore) AddCodeAttempt(id bson.ObjectId) (int, error) {
+	var counted struct {
+		CodeAttempts int `bson:"code_attempts"`
+	}
+	change := mgo.Change{Update: bson.M{"$inc": bson.M{"code_attempts": 1}}, ReturnNew: true}
+	err := s.do(func(db *mgo.Database) error {
+		_, err := db.C("users").FindId(id).Select(bson.M{"code_attempts": 1}).Apply(change, &counted)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counted.CodeAttempts, nil
+}
+
+func (s *MongoStore) FindUserByPhone(phone string) (*User, error) {
+	user := User{}
+	err := s.do(func(db *mgo.Database) error {
+		// numbers from before there were keys are stored as is
+		query := bson.M{"phone": bson.M{"$in": []string{PhoneIndex(phone), phone}}}
+		return db.C("users").Find(query).One(&user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) TeamUsers(teamId string) ([]User, error) {
+	var users []User
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("users").Find(bson.M{"team_id": teamId}).All(&users)
+	})
+	return users, err
+}
+
+func (s *MongoStore) Run(id bson.ObjectId) (*Run, error) {
+	run := Run{}
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("runs").FindId(id).One(&run)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (s *MongoStore) ActiveRun(teamId string) (*Run, error) {
+	run := Run{}
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("runs").Find(bson.M{"team_id": teamId, "active": true}).One(&run)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (s *MongoStore) ActiveRuns() ([]Run, error) {
+	var runs []Run
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("runs").Find(bson.M{"active": true}).All(&runs)
+	})
+	return runs, err
+}
+
+func (s *MongoStore) InsertRun(run *Run) error {
+	return s.do(func(db *mgo.Database) error {
+		return db.C("runs").Insert(run)
+	})
+}
+
+func (s *MongoStore) UpdateRun(id bson.ObjectId, fields Fields) error {
+	return s.do(func(db *mgo.Database) error {
+		return db.C("runs").UpdateId(id, bson.M{"$set": bson.M(fields)})
+	})
+}
+
+func (s *MongoStore) EndRun(id bson.ObjectId, ended time.Time) (*Run, error) {
+	run := Run{}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"active": false, "ended": ended}},
+		ReturnNew: true,
+	}
+	err := s.do(func(db *mgo.Database) error {
+		_, err := db.C("runs").Find(bson.M{"_id": id, "active": true}).Apply(change, &run)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (s *MongoStore) AddItem(runId bson.ObjectId, item Item) error {
+	return s.do(func(db *mgo.Database) error {
+		return db.C("runs").UpdateId(runId, bson.M{"$push": bson.M{"items": item}})
+	})
+}
+
+func (s *MongoStore) RemoveItem(runId bson.ObjectId, ownerId bson.ObjectId, reaction string) error {
+	update := bson.M{"$pull": bson.M{"items": bson.M{"owner_id": ownerId, "reaction": reaction}}}
+	return s.do(func(db *mgo.Database) error {
+		return db.C("runs").UpdateId(runId, update)
+	})
+}
+
+func (s *MongoStore) FindChannel(teamId string, channelId string) (*Channel, error) {
+	channel := Channel{}
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("channels").Find(bson.M{"team_id": teamId, "channel_id": channelId}).One(&channel)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+func (s *MongoStore) SaveChannel(channel *Channel) error {
+	if channel.Id == "" {
+		channel.Id = bson.NewObjectId()
+	}
+	return s.do(func(db *mgo.Database) error {
+		_, err := db.C("channels").UpsertId(channel.Id, channel)
+		return err
+	})
+}
+
+func (s *MongoStore) FindTeam(teamId string) (*Team, error) {
+	team := Team{}
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("teams").Find(bson.M{"team_id": teamId}).One(&team)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &team, nil
+}
+
+func (s *MongoStore) SaveTeam(team *Team) error {
+	if team.Id == "" {
+		team.Id = bson.NewObjectId()
+	}
+	return s.do(func(db *mgo.Database) error {
+		_, err := db.C("teams").UpsertId(team.Id, team)
+		return err
+	})
+}
+
+func (s *MongoStore) Seen(key string) (bool, error) {
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("seen").Insert(&SeenMessage{Key: key, Created: time.Now()})
+	})
+	if err == ErrDuplicate {
+		return true, nil
+	}
+	return false, err
+}
+
+func (s *MongoStore) Enqueue(msg *OutboxMessage) error {
+	if msg.Id == "" {
+		msg.Id = bson.NewObjectId()
+	}
+	return s.do(func(db *mgo.Database) error {
+		return db.C("outbox").Insert(msg)
+	})
+}
+
+func (s *MongoStore) ClaimOutbox(now time.Time) (*OutboxMessage, error) {
+	query := bson.M{"$or": []bson.M{
+		{"status": OutboxPending, "next_attempt": bson.M{"$lte": now}},
+		{"status": OutboxSending, "claimed": bson.M{"$lt": now.Add(-OutboxClaimTimeout)}},
+	}}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": OutboxSending, "claimed": now}},
+		ReturnNew: true,
+	}
+
+	msg := OutboxMessage{}
+	err := s.do(func(db *mgo.Database) error {
+		_, err := db.C("outbox").Find(query).Sort("next_attempt").Apply(change, &msg)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *MongoStore) UpdateOutbox(id bson.ObjectId, fields Fields) error {
+	return s.do(func(db *mgo.Database) error {
+		return db.C("outbox").UpdateId(id, bson.M{"$set": bson.M(fields)})
+	})
+}
+
+func (s *MongoStore) InsertDelivery(d *Delivery) error {
+	return s.do(func(db *mgo.Database) error {
+		return db.C("deliveries").Insert(d)
+	})
+}
+
+func (s *MongoStore) LastDelivery(to string, kind string) (*Delivery, error) {
+	d := Delivery{}
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("deliveries").Find(bson.M{"to": to, "kind": kind}).Sort("-created").One(&d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *MongoStore) SetDeliveryStatus(sid string, status string, errorCode string, updated time.Time) (*Delivery, error) {
+	d := Delivery{}
+	change := mgo.Change{
+		Update: bson.M{"$set": bson.M{"status": status, "error_code": errorCode, "updated": updated}},
+	}
+	query := bson.M{"_id": sid, "status": bson.M{"$nin": DeliveryFinal}}
+	err := s.do(func(db *mgo.Database) error {
+		_, err := db.C("deliveries").Find(query).Apply(change, &d)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *MongoStore) InsertAudit(entry *AuditEntry) error {
+	if entry.Id == "" {
+		entry.Id = bson.NewObjectId()
+	}
+	return s.do(func(db *mgo.Database) error {
+		return db.C("audit").Insert(entry)
+	})
+}
+
+func (s *MongoStore) AuditTrail(user bson.ObjectId) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := s.do(func(db *mgo.Database) error {
+		return db.C("audit").Find(bson.M{"user": user}).Sort("time").All(&entries)
+	})
+	return entries, err
+}
+
+func (s *MongoStore) EraseUser(user *User, pseudonym bson.ObjectId) error {
+	return s.do(func(db *mgo.Database) error {
+		if err := db.C("users").RemoveId(user.Id); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		if _, err := db.C("deliveries").RemoveAll(bson.M{"user": user.Id}); err != nil {
+			return err
+		}
+		outbox := bson.M{"platform": user.Platform, "team_id": user.TeamId, "user": user.UserId}
+		if _, err := db.C("outbox").RemoveAll(outbox); err != nil {
+			return err
+		}
+		_, err := db.C("audit").UpdateAll(bson.M{"user": user.Id}, bson.M{
+			"$set":   bson.M{"user": pseudonym},
+			"$unset": bson.M{"detail": ""},
+		})
+		return err
+	})
+}
+
+func (s *MongoStore) EachUser(fn func(user *User) error) error {
+	return s.do(func(db *mgo.Database) error {
+		iter := db.C("users").Find(nil).Sort("_id").Iter()
+		for {
+			user := User{}
+			if !iter.Next(&user) {
+				break
+			}
+			if err := fn(&user); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		return iter.Close()
+	})
+}
+
+func (s *MongoStore) EachRun(since time.Time, fn func(run *Run) error) error {
+	return s.do(func(db *mgo.Database) error {
+		iter := db.C("runs").Find(bson.M{"started": bson.M{"$gte": since}}).Sort("started").Iter()
+		for {
+			run := Run{}
+			if !iter.Next(&run) {
+				break
+			}
+			if err := fn(&run); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		return iter.Close()
+	})
+}
+
+func (s *MongoStore) Snapshot() (*Snapshot, error) {
+	snap := Snapshot{}
+	all := map[string]interface{}{
+		"users":      &snap.Users,
+		"runs":       &snap.Runs,
+		"channels":   &snap.Channels,
+		"teams":      &snap.Teams,
+		"seen":       &snap.Seen,
+		"outbox":     &snap.Outbox,
+		"deliveries": &snap.Deliveries,
+		"audit":      &snap.Audit,
+	}
+	err := s.do(func(db *mgo.Database) error {
+		for name, records := range all {
+			if err := db.C(name).Find(nil).All(records); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (s *MongoStore) Restore(snap *Snapshot) error {
+	return s.do(func(db *mgo.Database) error {
+		upsert := func(name string, id interface{}, doc interface{}) error {
+			_, err := db.C(name).UpsertId(id, doc)
+			return err
+		}
+
+		for i := range snap.Users {
+			if err := upsert("users", snap.Users[i].Id, &snap.Users[i]); err != nil {
+				return err
+			}
+		}
+		for i := range snap.Runs {
+			if err := upsert("runs", snap.Runs[i].Id, &snap.Runs[i]); err != nil {
+				return err
+			}
+		}
+		for i := range snap.Channels {
+			if err := upsert("channels", snap.Channels[i].Id, &snap.Channels[i]); err != nil {
+				return err
+			}
+		}
+		for i := range snap.Teams {
+			if err := upsert("teams", snap.Teams[i].Id, &snap.Teams[i]); err != nil {
+				return err
+			}
+		}
+		for i := range snap.Seen {
+			if err := upsert("seen", snap.Seen[i].Key, &snap.Seen[i]); err != nil {
+				return err
+			}
+		}
+		for i := range snap.Outbox {
+			if err := upsert("outbox", snap.Outbox[i].Id, &snap.Outbox[i]); err != nil {
+				return err
+			}
+		}
+		for i := range snap.Deliveries {
+			if err := upsert("deliveries", snap.Deliveries[i].Sid, &snap.Deliveries[i]); err != nil {
+				return err
+			}
+		}
+		for i := range snap.Audit {
+			if err := upsert("audit", snap.Audit[i].Id, &snap.Audit[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Setup brings the database up to date, see Migrations.
+func (s *MongoStore) Setup() error {
+	return s.Migrate()
+}
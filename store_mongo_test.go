@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMongoErr(t *testing.T) {
+	other := errors.New("something else")
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{nil, nil},
+		{mgo.ErrNotFound, ErrNotFound},
+		{&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}, ErrDuplicate},
+		{&mgo.QueryError{Code: 11000, Message: "E11000 duplicate key error"}, ErrDuplicate},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, ErrUnavailable},
+		{io.EOF, ErrUnavailable},
+		{errors.New("no reachable servers"), ErrUnavailable},
+		{other, other},
+	}
+	for _, c := range cases {
+		if err := mongoErr(c.err); err != c.want {
+			t.Errorf("mongoErr(%v) is %v instead of %v", c.err, err, c.want)
+		}
+	}
+}
+
+// unavailable checks that a few operations of s fail with ErrUnavailable.
+func unavailable(t *testing.T, s *MongoStore) {
+	if _, err := s.FindUser("T1", "U1"); err != ErrUnavailable {
+		t.Errorf("FindUser: %v", err)
+	}
+	if err := s.SaveUser(&User{}); err != ErrUnavailable {
+		t.Errorf("SaveUser: %v", err)
+	}
+	if seen, err := s.Seen("T1/1"); seen || err != ErrUnavailable {
+		t.Errorf("Seen: %t %v", seen, err)
+	}
+	if _, err := s.ClaimOutbox(time.Now()); err != ErrUnavailable {
+		t.Errorf("ClaimOutbox: %v", err)
+	}
+	if err := s.EachRun(time.Time{}, func(run *Run) error { return nil }); err != ErrUnavailable {
+		t.Errorf("EachRun: %v", err)
+	}
+}
+
+func TestMongoStoreNotConnected(t *testing.T) {
+	unavailable(t, &MongoStore{DB: "down"})
+}
+
+func TestMongoStoreClosed(t *testing.T) {
+	s := &MongoStore{DB: "down"}
+	s.Close()
+	unavailable(t, s)
+	// twice is fine too
+	s.Close()
+}
+
+// TestMongoDialDown dials a stub that hangs up on everyone, like a mongo
+// that's going down.
+func TestMongoDialDown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, err = mgo.DialWithTimeout(listener.Addr().String(), 500*time.Millisecond)
+	if err == nil {
+		t.Fatal("dialed a stub that hangs up")
+	}
+	if mongoErr(err) != ErrUnavailable {
+		t.Errorf("dialing a stub that hangs up: %v", err)
+	}
+}
@@ -0,0 +1,1031 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"ninja/chat"
+	"ninja/phone"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storeTests are what every Store has to get right, each one gets an empty
+// store of its own.
+var storeTests = []struct {
+	Name string
+	Run  func(t *testing.T, s Store)
+}{
+	{"users", testUsers},
+	{"phones", testPhones},
+	{"legacy users", testLegacyUsers},
+	{"runs", testRuns},
+	{"channels and teams", testChannelsAndTeams},
+	{"seen", testSeen},
+	{"outbox", testOutbox},
+	{"deliveries", testDeliveries},
+	{"audit", testAudit},
+	{"each", testEach},
+	{"erase", testErase},
+	{"phone keys", testPhoneKeys},
+	{"code attempts", testCodeAttempts},
+}
+
+// testStore runs storeTests against stores made by fresh.
+func testStore(t *testing.T, fresh func(t *testing.T) Store) {
+	for _, test := range storeTests {
+		test := test
+		t.Run(test.Name, func(t *testing.T) { test.Run(t, fresh(t)) })
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemoryStore() })
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFileStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	testStore(t, func(t *testing.T) Store {
+		s, err := NewFileStore(filepath.Join(dir, bson.NewObjectId().Hex()+".db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+// TestMongoStore needs a mongo to throw away, NINJA_TEST_MONGO_URL points at
+// it. Its ninja_test database is dropped before every test.
+func TestMongoStore(t *testing.T) {
+	url := os.Getenv("NINJA_TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("NINJA_TEST_MONGO_URL isn't set")
+	}
+	session, err := mgo.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	testStore(t, func(t *testing.T) Store {
+		if err := session.DB("ninja_test").DropDatabase(); err != nil {
+			t.Fatal(err)
+		}
+		s := &MongoStore{DB: "ninja_test", session: session}
+		if err := s.Setup(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+	session.DB("ninja_test").DropDatabase()
+}
+
+func TestFileStoreReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reload.db")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testUsers(t, s)
+	testRuns(t, s)
+	testAudit(t, s)
+	before, _ := s.Snapshot()
+	s.Close()
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := reopened.Snapshot()
+
+	if len(after.Users) != len(before.Users) {
+		t.Errorf("%d users came back instead of %d", len(after.Users), len(before.Users))
+	}
+	if len(after.Runs) != len(before.Runs) {
+		t.Errorf("%d runs came back instead of %d", len(after.Runs), len(before.Runs))
+	}
+	if len(after.Audit) != len(before.Audit) {
+		t.Errorf("%d audit entries came back instead of %d", len(after.Audit), len(before.Audit))
+	}
+}
+
+// TestMemoryStorePrunes checks that old seen keys and outbox messages that
+// are done go, mongo does that with TTL indexes.
+func TestMemoryStorePrunes(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	old := Snapshot{
+		Seen: []SeenMessage{{Key: "old", Created: now.Add(-SeenTTL - time.Minute)}},
+		Outbox: []OutboxMessage{
+			{Id: bson.NewObjectId(), Status: OutboxSent, Done: now.Add(-OutboxKeep - time.Minute)},
+			{Id: bson.NewObjectId(), Status: OutboxDead, Done: now.Add(-OutboxKeep - time.Minute)},
+			{Id: bson.NewObjectId(), Status: OutboxSent, Done: now.Add(-time.Minute)},
+		},
+	}
+	if err := s.Restore(&old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Seen("new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ClaimOutbox(now); err != ErrNotFound {
+		t.Errorf("claimed a message that's done: %v", err)
+	}
+	snap, _ := s.Snapshot()
+	if len(snap.Seen) != 1 || snap.Seen[0].Key != "new" {
+		t.Errorf("seen is %+v", snap.Seen)
+	}
+	if len(snap.Outbox) != 1 || snap.Outbox[0].Id != old.Outbox[2].Id {
+		t.Errorf("outbox is %+v", snap.Outbox)
+	}
+}
+
+func TestMemoryStoreMasksAudit(t *testing.T) {
+	s := NewMemoryStore()
+	user := bson.NewObjectId()
+	old := Snapshot{Audit: []AuditEntry{
+		{Id: bson.NewObjectId(), User: user, Action: "register", Detail: "+46701234567"},
+		{Id: bson.NewObjectId(), User: user, Action: "verify", Detail: "+467******67"},
+		{Id: bson.NewObjectId(), User: user, Action: "pause", Detail: "2026-10-19"},
+	}}
+	if err := s.Restore(&old); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	trail, err := s.AuditTrail(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	details := map[string]string{}
+	for _, entry := range trail {
+		details[entry.Action] = entry.Detail
+	}
+	want := map[string]string{"register": "+467******67", "verify": "+467******67", "pause": "2026-10-19"}
+	for action, detail := range want {
+		if details[action] != detail {
+			t.Errorf("%s is %q instead of %q", action, details[action], detail)
+		}
+	}
+}
+
+// TestBrainDown checks that the bot answers with BrainDown, instead of
+// falling over, when mongo isn't there. The store is never connected.
+func TestBrainDown(t *testing.T) {
+	store := Env.Store
+	Env.Store = &MongoStore{DB: "down"}
+	defer func() { Env.Store = store }()
+	if len(Commands) == 0 {
+		SetupCommands()
+	}
+
+	reply := BotHandler(&chat.Message{Platform: "slack", TeamId: "T1", UserId: "U1", Text: "startrun"})
+	if reply == nil || reply.Text != BrainDown {
+		t.Errorf("replied %+v", reply)
+	}
+}
+
+func testUsers(t *testing.T, s Store) {
+	user := &User{Id: bson.NewObjectId(), Platform: "slack", TeamId: "T1", UserId: "U1", Name: "bob"}
+	if err := s.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := s.FindUser("T1", "U1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found.Name = "changed"
+	again, err := s.User(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Name != "bob" {
+		t.Errorf("records are shared with callers, got %s", again.Name)
+	}
+	if err := s.InsertUser(&User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U1"}); err != ErrDuplicate {
+		t.Errorf("InsertUser of a user that exists: %v", err)
+	}
+	if _, err := s.FindUser("T2", "U1"); err != ErrNotFound {
+		t.Errorf("FindUser of another team: %v", err)
+	}
+	if _, err := s.User(bson.NewObjectId()); err != ErrNotFound {
+		t.Errorf("User of an unknown id: %v", err)
+	}
+
+	if err := s.UpdateUser(user.Id, Fields{"name": "robert", "notify": []string{"dm"}}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := s.User(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != "robert" {
+		t.Errorf("UpdateUser didn't set name, got %s", updated.Name)
+	}
+	if updated.UserId != "U1" {
+		t.Errorf("UpdateUser touched other fields, user id is %s", updated.UserId)
+	}
+	if len(updated.Notify) != 1 {
+		t.Errorf("UpdateUser didn't set notify, got %v", updated.Notify)
+	}
+
+	updated.Usual = "latte"
+	if err := s.SaveUser(updated); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := s.User(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Usual != "latte" || saved.Name != "robert" {
+		t.Errorf("SaveUser didn't save, got %+v", saved)
+	}
+	if err := s.SaveUser(&User{Id: bson.NewObjectId()}); err != ErrNotFound {
+		t.Errorf("SaveUser of an unknown user: %v", err)
+	}
+	if err := s.UpdateUser(bson.NewObjectId(), Fields{"name": "x"}); err != ErrNotFound {
+		t.Errorf("UpdateUser of an unknown user: %v", err)
+	}
+
+	users, err := s.Users([]bson.ObjectId{user.Id, bson.NewObjectId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Errorf("Users returned %d users instead of 1", len(users))
+	}
+	team, err := s.TeamUsers("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.TeamUsers("T2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(team) != 1 || len(other) != 0 {
+		t.Errorf("TeamUsers returned %d and %d users", len(team), len(other))
+	}
+}
+
+func testPhones(t *testing.T, s Store) {
+	bob := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U1", Phone: "+61412345678"}
+	alice := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U2"}
+	carol := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U3"}
+	for _, user := range []*User{bob, alice, carol} {
+		if err := s.InsertUser(user); err != nil {
+			t.Fatalf("users without a phone should not clash: %s", err)
+		}
+	}
+
+	found, err := s.FindUserByPhone("+61412345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Id != bob.Id {
+		t.Error("FindUserByPhone found the wrong user")
+	}
+	if _, err := s.FindUserByPhone("+61400000000"); err != ErrNotFound {
+		t.Errorf("FindUserByPhone of an unknown number: %v", err)
+	}
+
+	alice.Phone = bob.Phone
+	if err := s.SaveUser(alice); err != ErrDuplicate {
+		t.Errorf("SaveUser with a taken phone: %v", err)
+	}
+	if err := s.UpdateUser(carol.Id, Fields{"phone": bob.Phone}); err != ErrDuplicate {
+		t.Errorf("UpdateUser with a taken phone: %v", err)
+	}
+	if err := s.InsertUser(&User{Id: bson.NewObjectId(), TeamId: "T2", UserId: "U4", Phone: bob.Phone}); err != ErrDuplicate {
+		t.Errorf("InsertUser with a taken phone: %v", err)
+	}
+	if err := s.SaveUser(bob); err != nil {
+		t.Errorf("SaveUser clashed with itself: %v", err)
+	}
+}
+
+func testLegacyUsers(t *testing.T, s Store) {
+	if err := s.InsertUser(&User{Id: bson.NewObjectId(), UserId: "U1", Name: "old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := s.ClaimLegacyUser("T1", "U1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.TeamId != "T1" {
+		t.Errorf("claimed user is in team %q", user.TeamId)
+	}
+	if _, err := s.ClaimLegacyUser("T2", "U1"); err != ErrNotFound {
+		t.Errorf("user was claimed twice: %v", err)
+	}
+	found, err := s.FindUser("T1", "U1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "old" {
+		t.Error("claimed user lost its name")
+	}
+}
+
+func testRuns(t *testing.T, s Store) {
+	owner := bson.NewObjectId()
+	run := &Run{Id: bson.NewObjectId(), TeamId: "T1", Runner: owner, Items: []Item{}, Started: time.Now(), Active: true}
+	if err := s.InsertRun(run); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertRun(&Run{Id: bson.NewObjectId(), TeamId: "T2", Runner: owner, Items: []Item{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := s.ActiveRun("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.Id != run.Id {
+		t.Error("ActiveRun found the wrong run")
+	}
+	runs, err := s.ActiveRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Errorf("ActiveRuns returned %d runs instead of 1", len(runs))
+	}
+	if _, err := s.ActiveRun("T2"); err != ErrNotFound {
+		t.Errorf("ActiveRun of a team with an inactive run: %v", err)
+	}
+
+	items := []Item{
+		{Name: "latte", OwnerId: owner, Reaction: "coffee"},
+		{Name: "tea", OwnerId: owner, Reaction: "tea"},
+		{Name: "mocha", OwnerId: bson.NewObjectId(), Reaction: "coffee"},
+	}
+	for _, item := range items {
+		if err := s.AddItem(run.Id, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RemoveItem(run.Id, owner, "coffee"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateRun(run.Id, Fields{"thread_ts": "1234.5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ended, err := s.EndRun(run.Id, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ended.Items) != 2 || ended.Items[0].Name != "tea" {
+		t.Errorf("expected tea and mocha after removing the latte, got %+v", ended.Items)
+	}
+	if ended.ThreadTs != "1234.5" {
+		t.Error("UpdateRun didn't set the thread")
+	}
+	if ended.Active || ended.Ended.IsZero() {
+		t.Error("EndRun didn't end the run")
+	}
+	if _, err := s.EndRun(run.Id, time.Now()); err != ErrNotFound {
+		t.Errorf("run was ended twice: %v", err)
+	}
+	if _, err := s.ActiveRun("T1"); err != ErrNotFound {
+		t.Errorf("ended run is still active: %v", err)
+	}
+	if err := s.UpdateRun(bson.NewObjectId(), Fields{"active": false}); err != ErrNotFound {
+		t.Errorf("UpdateRun of an unknown run: %v", err)
+	}
+}
+
+func testChannelsAndTeams(t *testing.T, s Store) {
+	if _, err := s.FindChannel("T1", "C1"); err != ErrNotFound {
+		t.Errorf("FindChannel of an unknown channel: %v", err)
+	}
+	channel := &Channel{TeamId: "T1", ChannelId: "C1", Emoji: map[string]string{"coffee": "latte"}}
+	if err := s.SaveChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	if channel.Id == "" {
+		t.Error("SaveChannel didn't set an id")
+	}
+	channel.Emoji["tea"] = "tea"
+	if err := s.SaveChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	found, err := s.FindChannel("T1", "C1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found.Emoji) != 2 {
+		t.Errorf("SaveChannel didn't update, got %v", found.Emoji)
+	}
+
+	if _, err := s.FindTeam("T1"); err != ErrNotFound {
+		t.Errorf("FindTeam of an unknown team: %v", err)
+	}
+	team := &Team{TeamId: "T1", Name: "coffee"}
+	if err := s.SaveTeam(team); err != nil {
+		t.Fatal(err)
+	}
+	team.Config.RunMinutes = 10
+	if err := s.SaveTeam(team); err != nil {
+		t.Fatal(err)
+	}
+	foundTeam, err := s.FindTeam("T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foundTeam.Config.RunMinutes != 10 || foundTeam.Id != team.Id {
+		t.Errorf("SaveTeam didn't update, got %+v", foundTeam)
+	}
+}
+
+func testSeen(t *testing.T, s Store) {
+	seen := []bool{}
+	for _, key := range []string{"a", "a", "b"} {
+		ok, err := s.Seen(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen = append(seen, ok)
+	}
+	if seen[0] || !seen[1] || seen[2] {
+		t.Errorf("Seen returned %v", seen)
+	}
+}
+
+func testOutbox(t *testing.T, s Store) {
+	now := time.Now()
+	older := &OutboxMessage{Status: OutboxPending, NextAttempt: now.Add(-2 * time.Minute)}
+	newer := &OutboxMessage{Status: OutboxPending, NextAttempt: now.Add(-time.Minute)}
+	later := &OutboxMessage{Status: OutboxPending, NextAttempt: now.Add(time.Minute)}
+	for _, msg := range []*OutboxMessage{newer, later, older} {
+		if err := s.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if older.Id == "" {
+		t.Error("Enqueue didn't set an id")
+	}
+
+	first, err := s.ClaimOutbox(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.ClaimOutbox(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Id != older.Id || second.Id != newer.Id {
+		t.Error("messages were claimed out of order")
+	}
+	if first.Status != OutboxSending {
+		t.Errorf("claimed message is %s", first.Status)
+	}
+	if _, err := s.ClaimOutbox(now); err != ErrNotFound {
+		t.Errorf("claimed a message that isn't due: %v", err)
+	}
+
+	if err := s.UpdateOutbox(first.Id, Fields{"status": OutboxSent}); err != nil {
+		t.Fatal(err)
+	}
+	// the second claim times out, the third message is due by then
+	timeout := now.Add(OutboxClaimTimeout + time.Minute + time.Second)
+	stuck, err := s.ClaimOutbox(timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stuck.Id != newer.Id {
+		t.Error("timed out claim wasn't handed out again")
+	}
+	due, err := s.ClaimOutbox(timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due.Id != later.Id {
+		t.Error("due message wasn't handed out")
+	}
+	if _, err := s.ClaimOutbox(timeout); err != ErrNotFound {
+		t.Errorf("sent message was handed out: %v", err)
+	}
+}
+
+func testDeliveries(t *testing.T, s Store) {
+	now := time.Now()
+	user := bson.NewObjectId()
+	old := &Delivery{Sid: "SM1", Kind: DeliveryCode, User: user, To: "+61412345678", Status: "queued", Created: now.Add(-time.Hour)}
+	last := &Delivery{Sid: "SM2", Kind: DeliveryCode, User: user, To: "+61412345678", Status: "queued", Created: now}
+	for _, d := range []*Delivery{last, old} {
+		if err := s.InsertDelivery(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := s.LastDelivery("+61412345678", DeliveryCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Sid != "SM2" {
+		t.Errorf("LastDelivery found %s", found.Sid)
+	}
+	if _, err := s.LastDelivery("+61412345678", DeliveryOrder); err != ErrNotFound {
+		t.Errorf("LastDelivery of another kind: %v", err)
+	}
+
+	sent, err := s.SetDeliveryStatus("SM2", "sent", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := s.SetDeliveryStatus("SM2", "failed", "30003", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.Status != "queued" || failed.Status != "sent" {
+		t.Error("SetDeliveryStatus didn't return the previous status")
+	}
+	if _, err := s.SetDeliveryStatus("SM2", "delivered", "", now); err != ErrNotFound {
+		t.Errorf("final status was changed: %v", err)
+	}
+	if _, err := s.SetDeliveryStatus("SM3", "sent", "", now); err != ErrNotFound {
+		t.Errorf("unknown delivery was updated: %v", err)
+	}
+}
+
+func testAudit(t *testing.T, s Store) {
+	user := bson.NewObjectId()
+	now := time.Now()
+	entries := []*AuditEntry{
+		{User: user, Time: now, Action: "verify"},
+		{User: user, Time: now.Add(-time.Minute), Action: "register"},
+		{User: bson.NewObjectId(), Time: now, Action: "register"},
+	}
+	for _, entry := range entries {
+		if err := s.InsertAudit(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trail, err := s.AuditTrail(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trail) != 2 || trail[0].Action != "register" {
+		t.Errorf("AuditTrail should be register then verify, got %+v", trail)
+	}
+}
+
+func testErase(t *testing.T, s Store) {
+	user := &User{Id: bson.NewObjectId(), Platform: "slack", TeamId: "T1", UserId: "U1", Phone: "+46701234567"}
+	other := &User{Id: bson.NewObjectId(), Platform: "slack", TeamId: "T1", UserId: "U2"}
+	for _, u := range []*User{user, other} {
+		msg := &OutboxMessage{Platform: u.Platform, TeamId: u.TeamId, User: u.UserId, Status: OutboxPending}
+		if err := s.Enqueue(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.InsertUser(u); err != nil {
+			t.Fatal(err)
+		}
+		d := &Delivery{Sid: "SM" + u.Id.Hex(), Kind: DeliveryCode, User: u.Id, To: "+46701234567"}
+		if err := s.InsertDelivery(d); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.InsertAudit(&AuditEntry{User: u.Id, Time: time.Now(), Action: "register", Detail: u.Phone}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pseudonym := bson.NewObjectId()
+	if err := s.EraseUser(user, pseudonym); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.User(user.Id); err != ErrNotFound {
+		t.Errorf("User after EraseUser: %v", err)
+	}
+	if _, err := s.User(other.Id); err != nil {
+		t.Errorf("EraseUser removed someone else: %v", err)
+	}
+	if _, err := s.FindUserByPhone(user.Phone); err != ErrNotFound {
+		t.Errorf("FindUserByPhone after EraseUser: %v", err)
+	}
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Deliveries) != 1 || snap.Deliveries[0].User != other.Id {
+		t.Errorf("EraseUser left the deliveries as %+v", snap.Deliveries)
+	}
+	if len(snap.Outbox) != 1 || snap.Outbox[0].User != other.UserId {
+		t.Errorf("EraseUser left the outbox as %+v", snap.Outbox)
+	}
+	if len(snap.Audit) != 2 {
+		t.Errorf("EraseUser removed audit entries, %d left", len(snap.Audit))
+	}
+	if trail, err := s.AuditTrail(user.Id); err != nil || len(trail) != 0 {
+		t.Errorf("EraseUser left %+v under the old id: %v", trail, err)
+	}
+	trail, err := s.AuditTrail(pseudonym)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trail) != 1 || trail[0].Detail != "" {
+		t.Errorf("EraseUser left the audit trail as %+v", trail)
+	}
+}
+
+func testCodeAttempts(t *testing.T, s Store) {
+	user := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U1", CodeAttempts: 2}
+	if err := s.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int, 10)
+	for i := 0; i < cap(done); i++ {
+		go func() {
+			attempts, err := s.AddCodeAttempt(user.Id)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- attempts
+		}()
+	}
+	seen := map[int]bool{}
+	for i := 0; i < cap(done); i++ {
+		seen[<-done] = true
+	}
+	// everyone got a count of their own
+	for n := 3; n <= 12; n++ {
+		if !seen[n] {
+			t.Errorf("no attempt was number %d: %v", n, seen)
+		}
+	}
+	if saved, err := s.User(user.Id); err != nil || saved.CodeAttempts != 12 {
+		t.Errorf("AddCodeAttempt saved %+v: %v", saved, err)
+	}
+
+	if _, err := s.AddCodeAttempt(bson.NewObjectId()); err != ErrNotFound {
+		t.Errorf("AddCodeAttempt for nobody: %v", err)
+	}
+}
+
+func randomKey(id string) string {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	if id == "" {
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(raw)
+}
+
+// testPhoneKeys checks that numbers are sealed when stored, can still be
+// found and kept unique, and move to a new key with Rekey.
+func testPhoneKeys(t *testing.T, s Store) {
+	first, index := randomKey("1"), randomKey("")
+	old, err := phone.ParseKeyring(first, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := phone.ParseKeyring(randomKey("2")+","+first, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := Env.PhoneKeys
+	defer func() { Env.PhoneKeys = keys }()
+
+	Env.PhoneKeys = nil
+	legacy := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U0", Phone: "+46700000000"}
+	if err := s.InsertUser(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	Env.PhoneKeys = old
+	user := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U1", Phone: "+46701234567"}
+	if err := s.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+	doc := bson.M{}
+	clone(user, &doc)
+	if doc["phone"] != old.Index(user.Phone) {
+		t.Errorf("phone is stored as %v", doc["phone"])
+	}
+	if doc["phone_enc"] == nil || doc["phone_enc"] == user.Phone {
+		t.Errorf("phone_enc is %v", doc["phone_enc"])
+	}
+
+	found, err := s.FindUserByPhone(user.Phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Id != user.Id || found.Phone != user.Phone {
+		t.Errorf("FindUserByPhone found %s %s", found.Id.Hex(), found.Phone)
+	}
+	if phone.KeyId(found.phoneSealed) != "1" {
+		t.Errorf("the number was sealed with %q", found.phoneSealed)
+	}
+	foundLegacy, err := s.FindUserByPhone(legacy.Phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if foundLegacy.Id != legacy.Id {
+		t.Error("FindUserByPhone didn't find a number from before keys")
+	}
+	twice := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U2", Phone: user.Phone}
+	if err := s.InsertUser(twice); err != ErrDuplicate {
+		t.Errorf("InsertUser with a sealed number that's taken: %v", err)
+	}
+
+	// a number on its own is sealed by UpdateUser too
+	carol := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U3"}
+	if err := s.InsertUser(carol); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUser(carol.Id, Fields{"phone": "+46709999999"}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := s.FindUserByPhone("+46709999999"); err != nil || found.Id != carol.Id || phone.KeyId(found.phoneSealed) != "1" {
+		t.Errorf("after UpdateUser with a number FindUserByPhone found %+v: %v", found, err)
+	}
+	if err := s.UpdateUser(carol.Id, Fields{"phone": user.Phone}); err != ErrDuplicate {
+		t.Errorf("UpdateUser with a sealed number that's taken: %v", err)
+	}
+	if err := s.UpdateUser(carol.Id, Fields{"phone": ""}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := s.User(carol.Id); err != nil || found.Phone != "" {
+		t.Errorf("after clearing the number the user is %+v: %v", found, err)
+	}
+	if _, err := s.FindUserByPhone("+46709999999"); err != ErrNotFound {
+		t.Errorf("FindUserByPhone of a cleared number: %v", err)
+	}
+
+	Env.PhoneKeys = rotated
+	changed, err := Rekey(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Rekey(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the memory store seals numbers from before keys as soon as it copies them
+	if changed < 1 || again != 0 {
+		t.Errorf("Rekey changed %d and then %d numbers", changed, again)
+	}
+
+	after, err := s.FindUserByPhone(user.Phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Phone != user.Phone || phone.KeyId(after.phoneSealed) != "2" {
+		t.Errorf("after Rekey the number is %s sealed as %q", after.Phone, after.phoneSealed)
+	}
+	afterLegacy, err := s.FindUserByPhone(legacy.Phone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phone.KeyId(afterLegacy.phoneSealed) != "2" {
+		t.Errorf("Rekey left a number from before keys as %q", afterLegacy.phoneSealed)
+	}
+
+	sealed, _ := rotated.Seal(user.Phone)
+	if _, err := old.Open(sealed); err != phone.ErrUnknownKey {
+		t.Errorf("opening with a key that's gone: %v", err)
+	}
+}
+
+func testEach(t *testing.T, s Store) {
+	for _, id := range []string{"U2", "U1", "U3"} {
+		if err := s.InsertUser(&User{Id: bson.NewObjectId(), TeamId: "T1", UserId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	day := time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)
+	for _, days := range []int{2, 0, 1, 3} {
+		run := &Run{Id: bson.NewObjectId(), TeamId: "T1", Runner: bson.NewObjectId(), Started: day.AddDate(0, 0, days)}
+		if err := s.InsertRun(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users := 0
+	if err := s.EachUser(func(user *User) error { users++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if users != 3 {
+		t.Errorf("EachUser went through %d users instead of 3", users)
+	}
+
+	started := []time.Time{}
+	err := s.EachRun(day.AddDate(0, 0, 1), func(run *Run) error {
+		started = append(started, run.Started)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 3 || !started[0].Before(started[1]) || !started[1].Before(started[2]) {
+		t.Errorf("EachRun should go through the last 3 runs in order, got %v", started)
+	}
+
+	stop := errors.New("stop")
+	stopped := 0
+	if err := s.EachRun(time.Time{}, func(run *Run) error { stopped++; return stop }); stopped != 1 || err != stop {
+		t.Errorf("EachRun kept going after an error: %d %v", stopped, err)
+	}
+}
+
+func TestFileStoreAppends(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ninja.db")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := func() int64 {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	bob := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U1", Name: "bob"}
+	alice := &User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U2", Name: "alice"}
+	if err := s.InsertUser(bob); err != nil {
+		t.Fatal(err)
+	}
+	before := size()
+	if err := s.InsertUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUser(alice.Id, Fields{"name": "al"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EraseUser(bob, bson.NewObjectId()); err != nil {
+		t.Fatal(err)
+	}
+	full, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(full)) <= before {
+		t.Fatalf("the file went from %d to %d bytes", before, len(full))
+	}
+	s.Close()
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size() != int64(len(full)) {
+		t.Errorf("opening the file changed it from %d to %d bytes", len(full), size())
+	}
+	if reopened.appended != 4 {
+		t.Errorf("counted %d changes in the file instead of 4", reopened.appended)
+	}
+	if _, err := reopened.User(bob.Id); err != ErrNotFound {
+		t.Errorf("erased user came back: %v", err)
+	}
+	if user, err := reopened.User(alice.Id); err != nil || user.Name != "al" {
+		t.Errorf("updated user came back as %+v: %v", user, err)
+	}
+
+	reopened.Close()
+
+	// a crash halfway through the last change leaves it out
+	if err := ioutil.WriteFile(path, full[:len(full)-3], 0600); err != nil {
+		t.Fatal(err)
+	}
+	torn, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer torn.Close()
+	if _, err := torn.User(bob.Id); err != nil {
+		t.Errorf("user erased by the torn change is gone: %v", err)
+	}
+	if user, err := torn.User(alice.Id); err != nil || user.Name != "al" {
+		t.Errorf("changes before the torn one came back as %+v: %v", user, err)
+	}
+	// and what's left of it is cut off so the next change can follow
+	if err := torn.UpdateUser(alice.Id, Fields{"name": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	torn.Close()
+	again, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if user, err := again.User(alice.Id); err != nil || user.Name != "alice" {
+		t.Errorf("change after the torn one came back as %+v: %v", user, err)
+	}
+}
+
+func TestFileStoreLocked(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ninja.db")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(path); err == nil {
+		t.Fatal("opened a file store that's already open")
+	}
+	s.Close()
+	if err := s.InsertUser(&User{Id: bson.NewObjectId()}); err != ErrUnavailable {
+		t.Errorf("InsertUser after Close: %v", err)
+	}
+
+	again, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("couldn't open the file store once it was closed: %s", err)
+	}
+	again.Close()
+}
+
+func TestFileStoreNotOurs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	for _, data := range [][]byte{
+		[]byte("# not a ninja store\n"),
+		{0x05, 0, 0, 0, 0},
+		// {"a": "b"}, bson but not ours
+		{0x0e, 0, 0, 0, 0x02, 'a', 0, 0x02, 0, 0, 0, 'b', 0, 0},
+	} {
+		path := filepath.Join(dir, "other.db")
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if s, err := NewFileStore(path); err == nil {
+			s.Close()
+			t.Errorf("opened %q as a store", data)
+		}
+		if after, _ := ioutil.ReadFile(path); string(after) != string(data) {
+			t.Errorf("%q was written over with %q", data, after)
+		}
+	}
+}
+
+func TestFileStoreLegacy(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ninja.db")
+
+	user := User{Id: bson.NewObjectId(), TeamId: "T1", UserId: "U1", Name: "bob"}
+	if err := writeSnapshot(path, &Snapshot{Users: []User{user}}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if found, err := s.User(user.Id); err != nil || found.Name != "bob" {
+		t.Errorf("user from a snapshot file came back as %+v: %v", found, err)
+	}
+}
+
+func TestOpenStoreFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenStore("file://" + filepath.Join(dir, "ninja.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file, ok := s.(*MemoryStore); !ok || file.path == "" {
+		t.Errorf("file:// opened a %T", s)
+	} else {
+		file.Close()
+	}
+	if _, err := OpenStore("file://"); err == nil {
+		t.Error("file:// without a path worked")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"ninja/chat"
+	"ninja/phone"
+	"ninja/slack"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TeamConfig struct {
+	RunMinutes      int    `bson:"run_minutes"`
+	ReminderMinutes int    `bson:"reminder_minutes"`
+	TwilioNumber    string `bson:"twilio_number"`
+	Region          string `bson:"region"`
+}
+
+var DefaultTeamConfig = TeamConfig{
+	RunMinutes:      5,
+	ReminderMinutes: 1,
+}
+
+// Team is a slack workspace. Teams installed through oauth have their own
+// bot token, the team configured through env vars doesn't need to exist.
+type Team struct {
+	Id        bson.ObjectId `bson:"_id,omitempty"`
+	TeamId    string        `bson:"team_id"`
+	Name      string        `bson:"name"`
+	BotToken  string        `bson:"bot_token"`
+	BotUserId string        `bson:"bot_user_id"`
+	Scope     string        `bson:"scope"`
+	Installed time.Time     `bson:"installed"`
+	Config    TeamConfig    `bson:"config"`
+}
+
+// TwilioNumber is the number texts and calls for the team come from.
+func (t *Team) TwilioNumber() string {
+	if t.Config.TwilioNumber != "" {
+		return t.Config.TwilioNumber
+	}
+	return Env.Vars.TwilioNumber
+}
+
+var teamCache = struct {
+	sync.Mutex
+	teams map[string]*Team
+}{teams: make(map[string]*Team)}
+
+// GetTeam loads a team, unknown teams get the default config.
+func GetTeam(teamId string) (*Team, error) {
+	teamCache.Lock()
+	cached, ok := teamCache.teams[teamId]
+	teamCache.Unlock()
+	if ok {
+		team := *cached
+		return &team, nil
+	}
+
+	team, err := Env.Store.FindTeam(teamId)
+	if err == ErrNotFound {
+		team = &Team{TeamId: teamId}
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if team.Config.RunMinutes <= 0 {
+		team.Config.RunMinutes = DefaultTeamConfig.RunMinutes
+	}
+	if team.Config.ReminderMinutes < 0 || team.Config.ReminderMinutes >= team.Config.RunMinutes {
+		team.Config.ReminderMinutes = DefaultTeamConfig.ReminderMinutes
+	}
+
+	teamCache.Lock()
+	cached = team
+	teamCache.teams[teamId] = cached
+	teamCache.Unlock()
+
+	result := *cached
+	return &result, nil
+}
+
+func SaveTeam(team *Team) error {
+	if err := Env.Store.SaveTeam(team); err != nil {
+		return err
+	}
+	teamCache.Lock()
+	delete(teamCache.teams, team.TeamId)
+	teamCache.Unlock()
+	return nil
+}
+
+// TeamToken is used by the bot to find the token of installed teams.
+func TeamToken(teamId string) string {
+	team, err := GetTeam(teamId)
+	if err != nil {
+		log.Warnf("Could not load team %s: %s", teamId, err)
+		return ""
+	}
+	return team.BotToken
+}
+
+func OAuthApp() *slack.OAuthApp {
+	return &slack.OAuthApp{
+		ClientId:     Env.Vars.SlackClientId,
+		ClientSecret: Env.Vars.SlackClientSecret,
+		RedirectUrl:  Env.Vars.AppURL + "/slack/oauth",
+	}
+}
+
+const OAuthStateCookie = "ninja_oauth_state"
+
+// InstallHandler starts the "Add to Slack" flow.
+func InstallHandler(w http.ResponseWriter, r *http.Request) {
+	if Env.Vars.SlackClientId == "" {
+		http.Error(w, "Installing is not enabled", http.StatusNotFound)
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "Could not start install", http.StatusInternalServerError)
+		log.Warn("Could not generate oauth state: ", err)
+		return
+	}
+	state := hex.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     OAuthStateCookie,
+		Value:    state,
+		Path:     "/slack/oauth",
+		MaxAge:   600,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, OAuthApp().AuthorizeURL(state), http.StatusFound)
+}
+
+// OAuthHandler is where slack sends people back after installing.
+func OAuthHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if e := query.Get("error"); e != "" {
+		log.Infof("Install was cancelled: %s", e)
+		fmt.Fprintf(w, "Ninja was not installed (%s)", e)
+		return
+	}
+
+	cookie, err := r.Cookie(OAuthStateCookie)
+	if err != nil || cookie.Value == "" || cookie.Value != query.Get("state") {
+		http.Error(w, "Invalid state, please try installing again", http.StatusBadRequest)
+		log.Warnf("Got oauth callback with invalid state from %s", r.RemoteAddr)
+		return
+	}
+
+	install, err := OAuthApp().Exchange(query.Get("code"))
+	if err != nil {
+		http.Error(w, "Could not install", http.StatusBadGateway)
+		log.Warn("Could not exchange oauth code: ", err)
+		return
+	}
+
+	team, err := GetTeam(install.TeamId)
+	if err != nil {
+		http.Error(w, "Could not install", http.StatusInternalServerError)
+		log.Warn("Could not load team: ", err)
+		return
+	}
+
+	team.Name = install.TeamName
+	team.BotToken = install.BotToken
+	team.BotUserId = install.BotUserId
+	team.Scope = install.Scope
+	team.Installed = time.Now()
+
+	if err := SaveTeam(team); err != nil {
+		http.Error(w, "Could not install", http.StatusInternalServerError)
+		log.Warn("Could not save team: ", err)
+		return
+	}
+
+	log.Infof("Installed in %s (%s)", team.Name, team.TeamId)
+	fmt.Fprintf(w, "Ninja is now installed in %s, invite it to your coffee channel!", team.Name)
+}
+
+func ConfigListCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	team, err := GetTeam(m.TeamId)
+	if err != nil {
+		return ErrorReply(err)
+	}
+
+	settings := map[string]string{
+		"run_minutes":      strconv.Itoa(team.Config.RunMinutes),
+		"reminder_minutes": strconv.Itoa(team.Config.ReminderMinutes),
+		"twilio_number":    team.TwilioNumber(),
+		"region":           team.Config.Region,
+	}
+
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	msg := "```"
+	for i := 0; i < len(keys); i++ {
+		msg += fmt.Sprintf("\n%-20s %s", keys[i], settings[keys[i]])
+	}
+	msg += "```"
+
+	return chat.EphemeralReply(msg)
+}
+
+func ConfigCommand(args ArgMap, user *User, m *chat.Message) *chat.Reply {
+	if !user.Admin {
+		return chat.EphemeralReply("Only workspace admins can change my settings.")
+	}
+
+	team, err := GetTeam(m.TeamId)
+	if err != nil {
+		return ErrorReply(err)
+	}
+
+	key := args["key"]
+	value := strings.TrimSpace(args["value"])
+
+	switch key {
+	case "run_minutes", "reminder_minutes":
+		minutes, err := strconv.Atoi(value)
+		if err != nil || minutes < 0 {
+			return chat.EphemeralReply(fmt.Sprintf("`%s` needs to be a number of minutes.", key))
+		}
+		if key == "run_minutes" {
+			team.Config.RunMinutes = minutes
+		} else {
+			team.Config.ReminderMinutes = minutes
+		}
+		if team.Config.RunMinutes == 0 || team.Config.ReminderMinutes >= team.Config.RunMinutes {
+			return chat.EphemeralReply("Runs need to be longer than the reminder.")
+		}
+	case "twilio_number":
+		if value == "default" {
+			value = ""
+		}
+		team.Config.TwilioNumber = value
+	case "region":
+		value = strings.ToUpper(value)
+		if value == "DEFAULT" {
+			value = ""
+		} else if !phone.Known(value) {
+			return chat.EphemeralReply(fmt.Sprintf("I don't know the region `%s`, use a two letter country code like `AU`.", value))
+		}
+		team.Config.Region = value
+	default:
+		return chat.EphemeralReply(fmt.Sprintf("I don't have a setting called `%s`.", key))
+	}
+
+	if err := SaveTeam(team); err != nil {
+		return ErrorReply(err)
+	}
+
+	if value == "" {
+		return chat.EphemeralReply(fmt.Sprintf("Ok, %s is back to the default.", key))
+	}
+	return chat.EphemeralReply(fmt.Sprintf("Ok, %s is now %s.", key, value))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// TwilioSignature signs a request the way twilio does, an HMAC-SHA1 of the
+// full url followed by the sorted post parameters and their values.
+func TwilioSignature(token string, fullURL string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	payload := fullURL
+	for _, k := range keys {
+		values := append([]string{}, params[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			payload += k + v
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write([]byte(payload))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RequestURL is the url twilio requested. Behind a proxy the url we see
+// isn't what twilio signed, so the host comes from APP_URL when it's set.
+func RequestURL(r *http.Request) string {
+	if Env.Vars.AppURL != "" {
+		return strings.TrimRight(Env.Vars.AppURL, "/") + r.URL.RequestURI()
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// ValidTwilioRequest checks the X-Twilio-Signature header of r.
+func ValidTwilioRequest(r *http.Request) bool {
+	signature := r.Header.Get("X-Twilio-Signature")
+	if signature == "" || Env.Vars.TwilioToken == "" {
+		return false
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return false
+	}
+
+	expected := TwilioSignature(Env.Vars.TwilioToken, RequestURL(r), r.PostForm)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// TwilioOnly wraps a handler so that it only answers requests signed by
+// twilio.
+func TwilioOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ValidTwilioRequest(r) {
+			log.Warnf("Invalid twilio signature for %s from %s", RequestURL(r), r.RemoteAddr)
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
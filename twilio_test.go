@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// the example from https://www.twilio.com/docs/usage/security
+const (
+	exampleTwilioURL       = "https://mycompany.com/myapp.php?foo=1&bar=2"
+	exampleTwilioToken     = "12345"
+	exampleTwilioSignature = "0/KCTR6DLpKmkAf8muzZqo1nDgQ="
+)
+
+func exampleTwilioParams() url.Values {
+	return url.Values{
+		"CallSid": {"CA1234567890ABCDE"},
+		"Caller":  {"+12349013030"},
+		"Digits":  {"1234"},
+		"From":    {"+12349013030"},
+		"To":      {"+18005551212"},
+	}
+}
+
+func TestTwilioSignature(t *testing.T) {
+	if s := TwilioSignature(exampleTwilioToken, exampleTwilioURL, exampleTwilioParams()); s != exampleTwilioSignature {
+		t.Errorf("example request signed as %s", s)
+	}
+
+	tampered := exampleTwilioParams()
+	tampered.Set("Digits", "1235")
+	if s := TwilioSignature(exampleTwilioToken, exampleTwilioURL, tampered); s == exampleTwilioSignature {
+		t.Error("a tampered param signed the same")
+	}
+	if s := TwilioSignature(exampleTwilioToken, exampleTwilioURL+"&baz=3", exampleTwilioParams()); s == exampleTwilioSignature {
+		t.Error("a tampered url signed the same")
+	}
+}
+
+func TestValidTwilioRequest(t *testing.T) {
+	vars := Env.Vars
+	defer func() { Env.Vars = vars }()
+	Env.Vars = &EnvVars{AppURL: "https://mycompany.com/", TwilioToken: exampleTwilioToken}
+
+	valid := func(params url.Values, signature string) bool {
+		r := httptest.NewRequest("POST", "/myapp.php?foo=1&bar=2", strings.NewReader(params.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if signature != "" {
+			r.Header.Set("X-Twilio-Signature", signature)
+		}
+		return ValidTwilioRequest(r)
+	}
+
+	if !valid(exampleTwilioParams(), exampleTwilioSignature) {
+		t.Error("example request wasn't valid")
+	}
+	tampered := exampleTwilioParams()
+	tampered.Set("From", "+12349013031")
+	if valid(tampered, exampleTwilioSignature) {
+		t.Error("a tampered request was valid")
+	}
+	if valid(exampleTwilioParams(), "") {
+		t.Error("a request without a signature was valid")
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"math/big"
 )
 
 var CodeChars = []rune("abcdefghjkmnpqrstuvwxyz")
 
-func GenerateCode(length int) string {
+func GenerateCode(length int) (string, error) {
 	b := make([]rune, length)
+	max := big.NewInt(int64(len(CodeChars)))
 	for i := range b {
-		b[i] = CodeChars[rand.Intn(len(CodeChars))]
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = CodeChars[n.Int64()]
 	}
-	return string(b)
+	return string(b), nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"net/http"
+	"ninja/notify"
 	"time"
 )
 
@@ -19,7 +20,7 @@ func StaticHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func CallHandler(w http.ResponseWriter, r *http.Request) {
-	log.Infof("Incomming call from %s, %s", r.RemoteAddr, r.UserAgent())
+	log.Infof("Incomming call to %s (%s)", r.PostFormValue("To"), r.PostFormValue("CallSid"))
 	resp := twiml.NewResponse()
 	resp.Action(twiml.Play{Url: Env.Vars.AppURL + "/assets/roll.mp3"})
 	resp.Send(w)
@@ -30,8 +31,20 @@ func SetupWeb() {
 
 	http.HandleFunc("/", DefaultHandler)
 	http.HandleFunc("/slack", Env.Bot.SlackHandler)
+	http.HandleFunc("/slack/events", Env.Bot.EventsHandler)
+	http.HandleFunc("/slack/install", InstallHandler)
+	http.HandleFunc("/slack/oauth", OAuthHandler)
+	if Env.Mattermost != nil {
+		http.HandleFunc("/mattermost", Env.Mattermost.Handler)
+	}
 	http.HandleFunc("/assets/", StaticHandler)
-	http.HandleFunc("/call", CallHandler)
+	http.HandleFunc("/call", TwilioOnly(CallHandler))
+	http.HandleFunc("/say", TwilioOnly(notify.Say))
+	http.HandleFunc("/order/call", TwilioOnly(OrderCallHandler))
+	http.HandleFunc("/order/answer", TwilioOnly(OrderAnswerHandler))
+	http.HandleFunc("/sms", TwilioOnly(SMSHandler))
+	http.HandleFunc("/sms/status", TwilioOnly(SMSStatusHandler))
+	http.HandleFunc("/metrics", MetricsHandler)
 
 	log.Fatal(http.ListenAndServe(":"+Env.Vars.ServerPort, nil))
 }